@@ -29,6 +29,11 @@ const (
 
 	NodeAllocationStateStatusReady    = "Ready"
 	NodeAllocationStateStatusNotReady = "NotReady"
+
+	DeviceMissingReason             = "Missing"
+	DeviceResetFailedReason         = "ResetFailed"
+	DeviceIOMMUGroupNotViableReason = "IOMMUGroupNotViable"
+	DeviceExcludedReason            = "Excluded"
 )
 
 type NodeAllocationStateConfig struct {
@@ -0,0 +1,66 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	"fmt"
+	"sort"
+)
+
+// AllocationViolations returns a sorted description of every violation of the
+// allocation invariants of the spec: each allocated device must be one of the
+// AllocatableDevices, and no device may be allocated to more than one claim.
+func (s *NodeAllocationStateSpec) AllocationViolations() []string {
+	allocatable := make(map[string]struct{})
+	for _, device := range s.AllocatableDevices {
+		if device.Type() == PciDeviceType {
+			allocatable[device.Pci.UUID] = struct{}{}
+		}
+	}
+
+	claimUIDs := make([]string, 0, len(s.AllocatedClaims))
+	for claimUID := range s.AllocatedClaims {
+		claimUIDs = append(claimUIDs, claimUID)
+	}
+	sort.Strings(claimUIDs)
+
+	var violations []string
+	owners := make(map[string]string)
+	for _, claimUID := range claimUIDs {
+		allocation := s.AllocatedClaims[claimUID]
+		if allocation.Type() != PciDeviceType {
+			continue
+		}
+		for _, device := range allocation.Pci.Devices {
+			if _, exists := allocatable[device.UUID]; !exists {
+				violations = append(violations, fmt.Sprintf("device %s of claim %s is not allocatable", device.UUID, claimUID))
+			}
+			if owner, exists := owners[device.UUID]; exists {
+				if owner == claimUID {
+					violations = append(violations, fmt.Sprintf("device %s is listed twice in claim %s", device.UUID, claimUID))
+					continue
+				}
+				violations = append(violations, fmt.Sprintf("device %s is allocated to claims %s and %s", device.UUID, owner, claimUID))
+				continue
+			}
+			owners[device.UUID] = claimUID
+		}
+	}
+	sort.Strings(violations)
+
+	return violations
+}
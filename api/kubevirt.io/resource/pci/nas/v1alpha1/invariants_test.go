@@ -0,0 +1,121 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package v1alpha1
+
+import (
+	"reflect"
+	"testing"
+)
+
+func allocatablePcis(uuids ...string) []AllocatableDevice {
+	var devices []AllocatableDevice
+	for _, uuid := range uuids {
+		devices = append(devices, AllocatableDevice{Pci: &AllocatablePci{UUID: uuid}})
+	}
+	return devices
+}
+
+func allocatedPcis(uuids ...string) AllocatedDevices {
+	allocated := AllocatedDevices{Pci: &AllocatedPcis{}}
+	for _, uuid := range uuids {
+		allocated.Pci.Devices = append(allocated.Pci.Devices, AllocatedPci{UUID: uuid})
+	}
+	return allocated
+}
+
+func TestAllocationViolations(t *testing.T) {
+	tests := []struct {
+		name string
+		spec NodeAllocationStateSpec
+		want []string
+	}{
+		{
+			name: "empty",
+			spec: NodeAllocationStateSpec{},
+		},
+		{
+			name: "valid",
+			spec: NodeAllocationStateSpec{
+				AllocatableDevices: allocatablePcis("dev-a", "dev-b", "dev-c"),
+				AllocatedClaims: map[string]AllocatedDevices{
+					"claim-1": allocatedPcis("dev-a", "dev-b"),
+					"claim-2": allocatedPcis("dev-c"),
+				},
+			},
+		},
+		{
+			name: "device not allocatable",
+			spec: NodeAllocationStateSpec{
+				AllocatableDevices: allocatablePcis("dev-a"),
+				AllocatedClaims: map[string]AllocatedDevices{
+					"claim-1": allocatedPcis("dev-a", "dev-gone"),
+				},
+			},
+			want: []string{"device dev-gone of claim claim-1 is not allocatable"},
+		},
+		{
+			name: "device in two claims",
+			spec: NodeAllocationStateSpec{
+				AllocatableDevices: allocatablePcis("dev-a", "dev-b"),
+				AllocatedClaims: map[string]AllocatedDevices{
+					"claim-2": allocatedPcis("dev-a"),
+					"claim-1": allocatedPcis("dev-a", "dev-b"),
+				},
+			},
+			want: []string{"device dev-a is allocated to claims claim-1 and claim-2"},
+		},
+		{
+			name: "device twice in one claim",
+			spec: NodeAllocationStateSpec{
+				AllocatableDevices: allocatablePcis("dev-a"),
+				AllocatedClaims: map[string]AllocatedDevices{
+					"claim-1": allocatedPcis("dev-a", "dev-a"),
+				},
+			},
+			want: []string{"device dev-a is listed twice in claim claim-1"},
+		},
+		{
+			name: "several violations are sorted",
+			spec: NodeAllocationStateSpec{
+				AllocatableDevices: allocatablePcis("dev-a"),
+				AllocatedClaims: map[string]AllocatedDevices{
+					"claim-1": allocatedPcis("dev-x", "dev-a"),
+					"claim-2": allocatedPcis("dev-a"),
+				},
+			},
+			want: []string{
+				"device dev-a is allocated to claims claim-1 and claim-2",
+				"device dev-x of claim claim-1 is not allocatable",
+			},
+		},
+		{
+			name: "claims without PCI devices are ignored",
+			spec: NodeAllocationStateSpec{
+				AllocatedClaims: map[string]AllocatedDevices{
+					"claim-1": {},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.spec.AllocationViolations()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("AllocationViolations() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -25,6 +25,42 @@ type AllocatablePci struct {
 	UUID         string `json:"uuid"`
 	ResourceName string `json:"resourceName"`
 	PciAddress   string `json:"pciAddress"`
+	PciID        string `json:"pciID,omitempty"`
+	// VendorName and DeviceName are the names of the vendor and device ID
+	// from the PCI ID database, if known.
+	VendorName string `json:"vendorName,omitempty"`
+	DeviceName string `json:"deviceName,omitempty"`
+	// ClassCode is the class code of the device in hexadecimal, e.g. 010802.
+	ClassCode string `json:"classCode,omitempty"`
+	// SubsystemID is the subsystem vendor:device ID of the device.
+	SubsystemID string `json:"subsystemID,omitempty"`
+	// SerialNumber is the device serial number (DSN) of the device, e.g.
+	// 00-1b-21-ff-ff-8a-3c-10, if it has one.
+	SerialNumber string `json:"serialNumber,omitempty"`
+	// Driver is the driver the device is bound to, e.g. vfio-pci.
+	Driver string `json:"driver,omitempty"`
+	// LinkSpeed is the negotiated PCIe link speed of the device, e.g.
+	// 16.0 GT/s.
+	LinkSpeed string `json:"linkSpeed,omitempty"`
+	// LinkWidth is the negotiated number of PCIe lanes of the device.
+	LinkWidth int `json:"linkWidth,omitempty"`
+	// IOMMUGroup is the IOMMU group of the device. Devices sharing a group,
+	// like the functions of a multi-function device without ACS, are
+	// allocated together.
+	IOMMUGroup string `json:"iommuGroup,omitempty"`
+	// NumaNode is the NUMA node the device is attached to, unset if unknown.
+	NumaNode *int `json:"numaNode,omitempty"`
+	// RootComplex is the PCI host bridge the device is attached to, e.g.
+	// pci0000:00.
+	RootComplex string `json:"rootComplex,omitempty"`
+	// UpstreamBridges are the addresses of the PCI bridges between the root
+	// complex and the device, starting with the root port.
+	UpstreamBridges []string `json:"upstreamBridges,omitempty"`
+	// UnavailableReason is set for devices that must not be handed out to
+	// new claims, e.g. because they disappeared while still in use.
+	UnavailableReason string `json:"unavailableReason,omitempty"`
+	// UnavailableMessage is a human readable explanation of UnavailableReason.
+	UnavailableMessage string `json:"unavailableMessage,omitempty"`
 }
 
 // AllocatableDevice represents an allocatable device on a node.
@@ -48,6 +84,13 @@ type AllocatedPci struct {
 // AllocatedPcis represents a set of allocated PCIs.
 type AllocatedPcis struct {
 	Devices []AllocatedPci `json:"devices"`
+	// Shareable is set if the claim may be reserved by more than one pod, at
+	// most MaxConsumers unless that is zero.
+	Shareable    bool `json:"shareable,omitempty"`
+	MaxConsumers int  `json:"maxConsumers,omitempty"`
+	// AllocationPolicy is the policy of the resource class that picked the
+	// devices.
+	AllocationPolicy string `json:"allocationPolicy,omitempty"`
 }
 
 // AllocatedDevices represents a set of allocated devices.
@@ -66,6 +109,9 @@ func (r AllocatedDevices) Type() string {
 // PreparedPci represents a prepared PCI on a node.
 type PreparedPci struct {
 	UUID string `json:"uuid"`
+	// HostDriver is the driver the device was bound to before it was rebound
+	// to vfio-pci for the claim. Empty if the device was not rebound.
+	HostDriver string `json:"hostDriver,omitempty"`
 }
 
 // PreparedPcis represents a set of prepared PCIs on a node.
@@ -86,11 +132,28 @@ func (d PreparedDevices) Type() string {
 	return UnknownDeviceType
 }
 
+// DiscoverySelector selects the PCI devices advertised under a resource name.
+type DiscoverySelector struct {
+	ResourceName string `json:"resourceName"`
+	PCISelector  `json:",inline"`
+	AutoBindVFIO bool `json:"autoBindVFIO,omitempty"`
+}
+
+// DiscoveryConfig is the device discovery configuration of a node, resolved by
+// the controller from the DeviceClassParameters of the driver's resource classes.
+type DiscoveryConfig struct {
+	Selectors []DiscoverySelector `json:"selectors"`
+}
+
 // NodeAllocationStateSpec is the spec for the NodeAllocationState CRD.
 type NodeAllocationStateSpec struct {
+	DiscoveryConfig    *DiscoveryConfig            `json:"discoveryConfig,omitempty"`
 	AllocatableDevices []AllocatableDevice         `json:"allocatableDevices,omitempty"`
 	AllocatedClaims    map[string]AllocatedDevices `json:"allocatedClaims,omitempty"`
 	PreparedClaims     map[string]PreparedDevices  `json:"preparedClaims,omitempty"`
+	// DeviceReleaseTimes records when each device was last deallocated, by
+	// UUID, for the LeastRecentlyUsed allocation policy.
+	DeviceReleaseTimes map[string]metav1.Time `json:"deviceReleaseTimes,omitempty"`
 }
 
 // +genclient
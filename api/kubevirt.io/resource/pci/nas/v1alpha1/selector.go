@@ -0,0 +1,190 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PCISelector matches PCI devices by their attributes. A device must match
+// every field that is set. At least one of the vendor, class, subsystem and
+// address criteria has to be set, a selector matching any device has to say
+// so with a PCIVendorSelector of *.
+type PCISelector struct {
+	// PCIVendorSelector matches the vendor:device ID of a device, e.g.
+	// 10de:2330. Either part may be *, e.g. 10de:* for every device of a
+	// vendor, and * alone matches any ID.
+	PCIVendorSelector string `json:"pciVendorSelector,omitempty"`
+	// PCIClassSelector matches a prefix of the hexadecimal class code of a
+	// device, e.g. 0108 for all NVMe controllers or 0302 for 3D controllers.
+	PCIClassSelector string `json:"pciClassSelector,omitempty"`
+	// PCISubsystemSelector matches the subsystem vendor:device ID of a device
+	// the same way PCIVendorSelector matches the vendor:device ID.
+	PCISubsystemSelector string `json:"pciSubsystemSelector,omitempty"`
+	// PCIAddresses restricts the selector to the devices at these addresses,
+	// e.g. 0000:3b:00.0.
+	PCIAddresses []string `json:"pciAddresses,omitempty"`
+	// ExcludedPCIAddresses are the addresses of devices that are never
+	// selected, e.g. the boot disk or the management NIC of a node.
+	ExcludedPCIAddresses []string `json:"excludedPCIAddresses,omitempty"`
+	// ExcludedSerialNumbers are the device serial numbers of devices that are
+	// never selected, e.g. 00-1b-21-ff-ff-8a-3c-10.
+	ExcludedSerialNumbers []string `json:"excludedSerialNumbers,omitempty"`
+}
+
+// Normalize lowercases the selector and adds the default domain to PCI
+// addresses given without one.
+func (s *PCISelector) Normalize() {
+	s.PCIVendorSelector = strings.ToLower(s.PCIVendorSelector)
+	s.PCIClassSelector = strings.TrimPrefix(strings.ToLower(s.PCIClassSelector), "0x")
+	s.PCISubsystemSelector = strings.ToLower(s.PCISubsystemSelector)
+	for i, address := range s.PCIAddresses {
+		s.PCIAddresses[i] = normalizePCIAddress(address)
+	}
+	for i, address := range s.ExcludedPCIAddresses {
+		s.ExcludedPCIAddresses[i] = normalizePCIAddress(address)
+	}
+	for i, serialNumber := range s.ExcludedSerialNumbers {
+		s.ExcludedSerialNumbers[i] = strings.ToLower(serialNumber)
+	}
+}
+
+// Validate checks that the selector has a criterion, that the class selector
+// is hexadecimal and that the PCI addresses and serial numbers are well formed.
+func (s PCISelector) Validate() error {
+	class := strings.TrimPrefix(strings.ToLower(s.PCIClassSelector), "0x")
+	if s.PCIVendorSelector == "" && class == "" && s.PCISubsystemSelector == "" && len(s.PCIAddresses) == 0 {
+		return fmt.Errorf("PCI selector without pciVendorSelector, pciClassSelector, pciSubsystemSelector or pciAddresses would match every device")
+	}
+	if len(class) > 6 {
+		return fmt.Errorf("PCI class selector too long: %s", s.PCIClassSelector)
+	}
+	if class != "" {
+		if _, err := strconv.ParseUint(class, 16, 32); err != nil {
+			return fmt.Errorf("malformed PCI class selector: %s", s.PCIClassSelector)
+		}
+	}
+	for _, addresses := range [][]string{s.PCIAddresses, s.ExcludedPCIAddresses} {
+		for _, address := range addresses {
+			parts := strings.Split(normalizePCIAddress(address), ":")
+			if len(parts) != 3 || len(strings.Split(parts[2], ".")) != 2 {
+				return fmt.Errorf("malformed PCI address: %s", address)
+			}
+		}
+	}
+	for _, serialNumber := range s.ExcludedSerialNumbers {
+		if err := ValidateSerialNumber(serialNumber); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateSerialNumber checks that serialNumber is a device serial number in
+// the format lspci prints it in, eight hexadecimal bytes separated by dashes,
+// e.g. 00-1b-21-ff-ff-8a-3c-10.
+func ValidateSerialNumber(serialNumber string) error {
+	parts := strings.Split(serialNumber, "-")
+	if len(parts) != 8 {
+		return fmt.Errorf("malformed device serial number: %s", serialNumber)
+	}
+	for _, part := range parts {
+		if _, err := strconv.ParseUint(part, 16, 8); err != nil || len(part) != 2 {
+			return fmt.Errorf("malformed device serial number: %s", serialNumber)
+		}
+	}
+	return nil
+}
+
+// Matches reports whether the device with the given attributes is selected.
+// IDs and the class code are expected in lowercase hexadecimal without 0x
+// prefix, as found in the uevent and class files in sysfs.
+func (s PCISelector) Matches(pciAddress string, pciID string, classCode string, subsystemID string) bool {
+	if !matchesIDSelector(strings.ToLower(s.PCIVendorSelector), pciID) {
+		return false
+	}
+	if !strings.HasPrefix(classCode, strings.TrimPrefix(strings.ToLower(s.PCIClassSelector), "0x")) {
+		return false
+	}
+	if !matchesIDSelector(strings.ToLower(s.PCISubsystemSelector), subsystemID) {
+		return false
+	}
+	if len(s.PCIAddresses) == 0 {
+		return true
+	}
+	for _, address := range s.PCIAddresses {
+		if normalizePCIAddress(address) == normalizePCIAddress(pciAddress) {
+			return true
+		}
+	}
+	return false
+}
+
+// Excludes reports whether the device at pciAddress with the given serial
+// number is on one of the exclusion lists of the selector. Devices without a
+// serial number are only excluded by address.
+func (s PCISelector) Excludes(pciAddress string, serialNumber string) bool {
+	for _, address := range s.ExcludedPCIAddresses {
+		if normalizePCIAddress(address) == normalizePCIAddress(pciAddress) {
+			return true
+		}
+	}
+	if serialNumber == "" {
+		return false
+	}
+	for _, excluded := range s.ExcludedSerialNumbers {
+		if strings.EqualFold(excluded, serialNumber) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesIDSelector matches a vendor:device ID against a selector of the same
+// form, in which either part may be *. An empty selector or * matches any ID,
+// and a selector ending in * matches any ID with the preceding prefix.
+func matchesIDSelector(selector string, id string) bool {
+	if selector == "" || selector == "*" {
+		return true
+	}
+	selectorParts := strings.Split(selector, ":")
+	idParts := strings.Split(id, ":")
+	if len(selectorParts) != 2 || len(idParts) != 2 {
+		if strings.HasSuffix(selector, "*") {
+			return strings.HasPrefix(id, strings.TrimSuffix(selector, "*"))
+		}
+		return selector == id
+	}
+	for i := range selectorParts {
+		if selectorParts[i] != "*" && selectorParts[i] != idParts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizePCIAddress lowercases address and adds the default domain 0000 if
+// it has none.
+func normalizePCIAddress(address string) string {
+	address = strings.ToLower(address)
+	if strings.Count(address, ":") == 1 {
+		address = "0000:" + address
+	}
+	return address
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1alpha1
+
+import (
+	"testing"
+)
+
+func TestPCISelectorValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector PCISelector
+		wantErr  bool
+	}{
+		{
+			name:     "empty",
+			selector: PCISelector{},
+			wantErr:  true,
+		},
+		{
+			name:     "only exclusions",
+			selector: PCISelector{ExcludedPCIAddresses: []string{"0000:00:1f.2"}, ExcludedSerialNumbers: []string{"00-1b-21-ff-ff-8a-3c-10"}},
+			wantErr:  true,
+		},
+		{
+			name:     "only 0x class prefix",
+			selector: PCISelector{PCIClassSelector: "0x"},
+			wantErr:  true,
+		},
+		{
+			name:     "explicit wildcard",
+			selector: PCISelector{PCIVendorSelector: "*"},
+		},
+		{
+			name:     "vendor",
+			selector: PCISelector{PCIVendorSelector: "1b36:0010"},
+		},
+		{
+			name:     "class",
+			selector: PCISelector{PCIClassSelector: "0108"},
+		},
+		{
+			name:     "subsystem",
+			selector: PCISelector{PCISubsystemSelector: "1af4:*"},
+		},
+		{
+			name:     "addresses",
+			selector: PCISelector{PCIAddresses: []string{"00:07.0"}},
+		},
+		{
+			name:     "malformed class",
+			selector: PCISelector{PCIClassSelector: "nvme"},
+			wantErr:  true,
+		},
+		{
+			name:     "malformed address",
+			selector: PCISelector{PCIVendorSelector: "*", ExcludedPCIAddresses: []string{"00:07"}},
+			wantErr:  true,
+		},
+		{
+			name:     "malformed serial number",
+			selector: PCISelector{PCIVendorSelector: "*", ExcludedSerialNumbers: []string{"001b21ffff8a3c10"}},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.selector.Validate()
+			if tt.wantErr && err == nil {
+				t.Errorf("Validate() succeeded, want error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("Validate() = %v, want no error", err)
+			}
+		})
+	}
+}
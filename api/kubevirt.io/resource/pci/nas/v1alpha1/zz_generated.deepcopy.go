@@ -31,7 +31,7 @@ func (in *AllocatableDevice) DeepCopyInto(out *AllocatableDevice) {
 	if in.Pci != nil {
 		in, out := &in.Pci, &out.Pci
 		*out = new(AllocatablePci)
-		**out = **in
+		(*in).DeepCopyInto(*out)
 	}
 }
 
@@ -48,6 +48,16 @@ func (in *AllocatableDevice) DeepCopy() *AllocatableDevice {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AllocatablePci) DeepCopyInto(out *AllocatablePci) {
 	*out = *in
+	if in.NumaNode != nil {
+		in, out := &in.NumaNode, &out.NumaNode
+		*out = new(int)
+		**out = **in
+	}
+	if in.UpstreamBridges != nil {
+		in, out := &in.UpstreamBridges, &out.UpstreamBridges
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AllocatablePci.
@@ -115,6 +125,44 @@ func (in *AllocatedPcis) DeepCopy() *AllocatedPcis {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DiscoveryConfig) DeepCopyInto(out *DiscoveryConfig) {
+	*out = *in
+	if in.Selectors != nil {
+		in, out := &in.Selectors, &out.Selectors
+		*out = make([]DiscoverySelector, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DiscoveryConfig.
+func (in *DiscoveryConfig) DeepCopy() *DiscoveryConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(DiscoveryConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DiscoverySelector) DeepCopyInto(out *DiscoverySelector) {
+	*out = *in
+	in.PCISelector.DeepCopyInto(&out.PCISelector)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DiscoverySelector.
+func (in *DiscoverySelector) DeepCopy() *DiscoverySelector {
+	if in == nil {
+		return nil
+	}
+	out := new(DiscoverySelector)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *NodeAllocationState) DeepCopyInto(out *NodeAllocationState) {
 	*out = *in
@@ -196,6 +244,11 @@ func (in *NodeAllocationStateList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *NodeAllocationStateSpec) DeepCopyInto(out *NodeAllocationStateSpec) {
 	*out = *in
+	if in.DiscoveryConfig != nil {
+		in, out := &in.DiscoveryConfig, &out.DiscoveryConfig
+		*out = new(DiscoveryConfig)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.AllocatableDevices != nil {
 		in, out := &in.AllocatableDevices, &out.AllocatableDevices
 		*out = make([]AllocatableDevice, len(*in))
@@ -217,6 +270,13 @@ func (in *NodeAllocationStateSpec) DeepCopyInto(out *NodeAllocationStateSpec) {
 			(*out)[key] = *val.DeepCopy()
 		}
 	}
+	if in.DeviceReleaseTimes != nil {
+		in, out := &in.DeviceReleaseTimes, &out.DeviceReleaseTimes
+		*out = make(map[string]v1.Time, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeAllocationStateSpec.
@@ -229,6 +289,36 @@ func (in *NodeAllocationStateSpec) DeepCopy() *NodeAllocationStateSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PCISelector) DeepCopyInto(out *PCISelector) {
+	*out = *in
+	if in.PCIAddresses != nil {
+		in, out := &in.PCIAddresses, &out.PCIAddresses
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ExcludedPCIAddresses != nil {
+		in, out := &in.ExcludedPCIAddresses, &out.ExcludedPCIAddresses
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ExcludedSerialNumbers != nil {
+		in, out := &in.ExcludedSerialNumbers, &out.ExcludedSerialNumbers
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PCISelector.
+func (in *PCISelector) DeepCopy() *PCISelector {
+	if in == nil {
+		return nil
+	}
+	out := new(PCISelector)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *PreparedDevices) DeepCopyInto(out *PreparedDevices) {
 	*out = *in
@@ -23,15 +23,66 @@ const (
 	Version   = "v1alpha1"
 
 	PciClaimParametersKind = "PciClaimParameters"
+
+	ExactCountAllocationMode = "ExactCount"
+	AllAllocationMode        = "All"
+
+	ExclusiveSharing = "Exclusive"
+	SharedSharing    = "Shared"
+
+	RequiredNUMAPolicy  = "Required"
+	PreferredNUMAPolicy = "Preferred"
+
+	// PodNUMAAffinityAnnotation set to SingleNUMANodeAffinity on a pod makes
+	// all PCI claims of the pod allocate devices attached to one NUMA node.
+	PodNUMAAffinityAnnotation = GroupName + "/numa-affinity"
+	SingleNUMANodeAffinity    = "single-numa-node"
+
+	InAttributeOperator           = "In"
+	NotInAttributeOperator        = "NotIn"
+	ExistsAttributeOperator       = "Exists"
+	DoesNotExistAttributeOperator = "DoesNotExist"
+	GtAttributeOperator           = "Gt"
+	LtAttributeOperator           = "Lt"
+
+	// FirstFitAllocationPolicy allocates the devices with the lowest PCI
+	// addresses first.
+	FirstFitAllocationPolicy = "FirstFit"
+	// PackAllocationPolicy fills up the NUMA nodes that already have the most
+	// devices in use, keeping the others free for large claims.
+	PackAllocationPolicy = "Pack"
+	// SpreadNUMAAllocationPolicy spreads devices evenly across NUMA nodes.
+	SpreadNUMAAllocationPolicy = "SpreadNUMA"
+	// LeastRecentlyUsedAllocationPolicy allocates the devices that were
+	// released longest ago first, evening out wear.
+	LeastRecentlyUsedAllocationPolicy = "LeastRecentlyUsed"
+
+	SwitchPCIeLocality      = "Switch"
+	RootPortPCIeLocality    = "RootPort"
+	RootComplexPCIeLocality = "RootComplex"
+
+	// PodPCIeLocalityAnnotation set to a PCIe locality on a pod requires the
+	// devices of all PCI claims of the pod to be attached below the same PCIe
+	// switch, root port or root complex.
+	PodPCIeLocalityAnnotation = GroupName + "/pcie-locality"
+
+	// NodeExcludedDevicesAnnotation on a node holds a comma separated list of
+	// PCI addresses and device serial numbers of devices of the node that
+	// must never be advertised, e.g. its boot disk. Serial numbers are given
+	// as eight hexadecimal bytes separated by dashes, e.g.
+	// 00-1b-21-ff-ff-8a-3c-10.
+	NodeExcludedDevicesAnnotation = GroupName + "/excluded-devices"
 )
 
 func DefaultDeviceClassParametersSpec() *DeviceClassParametersSpec {
 	return &DeviceClassParametersSpec{
 		DeviceSelector: []DeviceSelector{
 			{
-				Type:              nascrd.PciDeviceType,
-				ResourceName:      "*",
-				PCIVendorSelector: "*",
+				Type:         nascrd.PciDeviceType,
+				ResourceName: "*",
+				PCISelector: nascrd.PCISelector{
+					PCIVendorSelector: "*",
+				},
 			},
 		},
 	}
@@ -39,6 +90,8 @@ func DefaultDeviceClassParametersSpec() *DeviceClassParametersSpec {
 
 func DefaultPciClaimParametersSpec() *PciClaimParametersSpec {
 	return &PciClaimParametersSpec{
-		DeviceName: "*",
+		DeviceName:     "*",
+		AllocationMode: ExactCountAllocationMode,
+		Count:          1,
 	}
 }
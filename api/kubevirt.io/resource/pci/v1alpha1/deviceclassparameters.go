@@ -18,18 +18,32 @@ package v1alpha1
 
 import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nascrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/nas/v1alpha1"
 )
 
 // DeviceSelector allows one to match on a specific type of Device as part of the class.
+//
+// The PCI selector fields select devices by vendor:device ID, class code,
+// subsystem ID and address. A device has to match all of the fields set.
 type DeviceSelector struct {
-	Type              string `json:"type"`
-	ResourceName      string `json:"resourceName"`
-	PCIVendorSelector string `json:"pciVendorSelector"`
+	Type               string `json:"type"`
+	ResourceName       string `json:"resourceName"`
+	nascrd.PCISelector `json:",inline"`
+	// AutoBindVFIO lets matching devices stay on their host driver until a
+	// claim is prepared, at which point they are rebound to vfio-pci. The
+	// host driver is restored when the claim is unprepared. Only honored by
+	// kubelet plugins started with --auto-bind-vfio.
+	AutoBindVFIO bool `json:"autoBindVFIO,omitempty"`
 }
 
 // DeviceClassParametersSpec is the spec for the DeviceClassParametersSpec CRD.
 type DeviceClassParametersSpec struct {
 	DeviceSelector []DeviceSelector `json:"deviceSelector,omitempty"`
+	// AllocationPolicy decides which of the matching devices of a node are
+	// allocated to a claim: FirstFit (the default), Pack, SpreadNUMA or
+	// LeastRecentlyUsed.
+	AllocationPolicy string `json:"allocationPolicy,omitempty"`
 }
 
 // +genclient
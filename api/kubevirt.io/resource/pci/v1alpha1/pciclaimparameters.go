@@ -23,6 +23,60 @@ import (
 // PciClaimParametersSpec is the spec for the PciClaimParameters CRD.
 type PciClaimParametersSpec struct {
 	DeviceName string `json:"deviceName"`
+	// AllocationMode is either ExactCount, to allocate Count devices, or All,
+	// to allocate every matching device on the node. Defaults to ExactCount.
+	AllocationMode string `json:"allocationMode,omitempty"`
+	// Count is the number of devices to allocate in ExactCount mode. Defaults to 1.
+	// Devices sharing an IOMMU group, like the functions of a multi-function
+	// device without ACS, are allocated together. Every device of a group that
+	// matches the claim counts, and groups holding more matching devices than
+	// are still requested are skipped. The devices of a group that do not
+	// match the claim, even of other resource names, come along on top of
+	// Count.
+	Count int `json:"count,omitempty"`
+	// Sharing is either Exclusive, to reserve the claim for a single pod, or
+	// Shared, to let several pods reserve it. Defaults to Exclusive, as a
+	// device passed through with VFIO can only be opened by one VM.
+	Sharing string `json:"sharing,omitempty"`
+	// MaxConsumers limits the number of pods reserving a Shared claim. Zero
+	// leaves only the limit of the ResourceClaim API. It is enforced when the
+	// claim is prepared on the node, not when a pod reserves the claim.
+	MaxConsumers int `json:"maxConsumers,omitempty"`
+	// NUMA restricts the allocation to devices local to a NUMA node.
+	NUMA *NUMAAffinity `json:"numa,omitempty"`
+	// PCIeLocality requires all devices of the claim to be attached below the
+	// same PCIe Switch, RootPort or RootComplex.
+	PCIeLocality string `json:"pcieLocality,omitempty"`
+	// Selector restricts the allocation to devices whose published attributes
+	// satisfy all of the requirements.
+	Selector []DeviceAttributeRequirement `json:"selector,omitempty"`
+}
+
+// DeviceAttributeRequirement matches an attribute of the devices published in
+// the NodeAllocationState against a set of values.
+type DeviceAttributeRequirement struct {
+	// Attribute is one of vendorID, deviceID, pciID, pciAddress, classCode,
+	// subsystemID, serialNumber, vendorName, deviceName, driver, iommuGroup,
+	// numaNode, linkSpeed, linkWidth and rootComplex.
+	Attribute string `json:"attribute"`
+	// Operator is one of In, NotIn, Exists, DoesNotExist, Gt and Lt. Gt and
+	// Lt compare numerically and only apply to numaNode, linkWidth and
+	// linkSpeed in GT/s.
+	Operator string `json:"operator"`
+	// Values are compared to the attribute case-insensitively. In and NotIn
+	// need at least one value, Gt and Lt exactly one, and Exists and
+	// DoesNotExist none.
+	Values []string `json:"values,omitempty"`
+}
+
+// NUMAAffinity describes the NUMA node the devices of a claim should be local to.
+type NUMAAffinity struct {
+	// Node is the NUMA node the devices should be attached to.
+	Node int `json:"node"`
+	// Policy is either Required, to only allocate devices attached to Node,
+	// or Preferred, to fall back to devices on other NUMA nodes. Defaults to
+	// Required. Devices with an unknown NUMA node never satisfy Node.
+	Policy string `json:"policy,omitempty"`
 }
 
 // +genclient
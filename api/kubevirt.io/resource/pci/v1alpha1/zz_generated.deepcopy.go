@@ -24,6 +24,26 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DeviceAttributeRequirement) DeepCopyInto(out *DeviceAttributeRequirement) {
+	*out = *in
+	if in.Values != nil {
+		in, out := &in.Values, &out.Values
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DeviceAttributeRequirement.
+func (in *DeviceAttributeRequirement) DeepCopy() *DeviceAttributeRequirement {
+	if in == nil {
+		return nil
+	}
+	out := new(DeviceAttributeRequirement)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *DeviceClassParameters) DeepCopyInto(out *DeviceClassParameters) {
 	*out = *in
@@ -88,7 +108,9 @@ func (in *DeviceClassParametersSpec) DeepCopyInto(out *DeviceClassParametersSpec
 	if in.DeviceSelector != nil {
 		in, out := &in.DeviceSelector, &out.DeviceSelector
 		*out = make([]DeviceSelector, len(*in))
-		copy(*out, *in)
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
 	}
 }
 
@@ -105,6 +127,7 @@ func (in *DeviceClassParametersSpec) DeepCopy() *DeviceClassParametersSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *DeviceSelector) DeepCopyInto(out *DeviceSelector) {
 	*out = *in
+	in.PCISelector.DeepCopyInto(&out.PCISelector)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DeviceSelector.
@@ -117,12 +140,27 @@ func (in *DeviceSelector) DeepCopy() *DeviceSelector {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NUMAAffinity) DeepCopyInto(out *NUMAAffinity) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NUMAAffinity.
+func (in *NUMAAffinity) DeepCopy() *NUMAAffinity {
+	if in == nil {
+		return nil
+	}
+	out := new(NUMAAffinity)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *PciClaimParameters) DeepCopyInto(out *PciClaimParameters) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
-	out.Spec = in.Spec
+	in.Spec.DeepCopyInto(&out.Spec)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PciClaimParameters.
@@ -178,6 +216,18 @@ func (in *PciClaimParametersList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *PciClaimParametersSpec) DeepCopyInto(out *PciClaimParametersSpec) {
 	*out = *in
+	if in.NUMA != nil {
+		in, out := &in.NUMA, &out.NUMA
+		*out = new(NUMAAffinity)
+		**out = **in
+	}
+	if in.Selector != nil {
+		in, out := &in.Selector, &out.Selector
+		*out = make([]DeviceAttributeRequirement, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PciClaimParametersSpec.
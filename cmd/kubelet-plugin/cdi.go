@@ -18,6 +18,7 @@ package main
 
 import (
 	"fmt"
+	"strings"
 
 	cdiapi "github.com/container-orchestrated-devices/container-device-interface/pkg/cdi"
 	cdispec "github.com/container-orchestrated-devices/container-device-interface/specs-go"
@@ -37,6 +38,9 @@ const (
 
 type CDIHandler struct {
 	registry cdiapi.Registry
+	// skipDeviceNodes is set when serving fake devices, whose VFIO device
+	// nodes do not exist on the host.
+	skipDeviceNodes bool
 }
 
 func NewCDIHandler(config *Config) (*CDIHandler, error) {
@@ -50,7 +54,8 @@ func NewCDIHandler(config *Config) (*CDIHandler, error) {
 	}
 
 	handler := &CDIHandler{
-		registry: registry,
+		registry:        registry,
+		skipDeviceNodes: config.fakeDevices != nil,
 	}
 
 	return handler, nil
@@ -98,6 +103,13 @@ func (cdi *CDIHandler) CreateClaimSpecFile(claimUID string, devices *PreparedDev
 	}
 	switch devices.Type() {
 	case nascrd.PciDeviceType:
+		// All devices of the claim sharing a resource name are exposed through
+		// a single comma separated variable, as KubeVirt expects it.
+		pciAddresses := make(map[string][]string)
+		for _, device := range devices.Pci.Devices {
+			pciAddresses[device.resourceName] = append(pciAddresses[device.resourceName], device.pciAddress)
+		}
+
 		for _, device := range devices.Pci.Devices {
 
 			resouceNameEnvVar := util.ResourceNameToEnvVar(PCIResourcePrefix, device.resourceName)
@@ -105,11 +117,13 @@ func (cdi *CDIHandler) CreateClaimSpecFile(claimUID string, devices *PreparedDev
 				Name: device.uuid,
 				ContainerEdits: cdispec.ContainerEdits{
 					Env: []string{
-						fmt.Sprintf(resouceNameEnvVar+"=%s", device.pciAddress),
+						fmt.Sprintf(resouceNameEnvVar+"=%s", strings.Join(pciAddresses[device.resourceName], ",")),
 					},
-					DeviceNodes: formatVFIODeviceSpecs(device.iommuGroup),
 				},
 			}
+			if !cdi.skipDeviceNodes {
+				cdiDevice.ContainerEdits.DeviceNodes = formatVFIODeviceSpecs(device.iommuGroup)
+			}
 			spec.Devices = append(spec.Devices, cdiDevice)
 		}
 	default:
@@ -23,6 +23,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"log"
 	"os"
@@ -33,11 +34,27 @@ import (
 	cdispec "github.com/container-orchestrated-devices/container-device-interface/specs-go"
 )
 
+const (
+	// pciConfigHeaderSize is the size of the standard config space header,
+	// which is all the kernel lets processes without CAP_SYS_ADMIN read.
+	pciConfigHeaderSize = 64
+	// pciExtendedCapabilitiesOffset is where the PCI Express extended
+	// capabilities start in the config space of a device.
+	pciExtendedCapabilitiesOffset = 0x100
+	// pciExtendedCapabilityDSN is the ID of the device serial number
+	// extended capability.
+	pciExtendedCapabilityDSN = 0x0003
+)
+
 type DeviceHandler interface {
 	GetDeviceIOMMUGroup(basepath string, pciAddress string) (string, error)
 	GetDeviceDriver(basepath string, pciAddress string) (string, error)
 	GetDeviceNumaNode(basepath string, pciAddress string) (numaNode int)
 	GetDevicePCIID(basepath string, pciAddress string) (string, error)
+	GetDeviceClass(basepath string, pciAddress string) (string, error)
+	GetDeviceSubsystemID(basepath string, pciAddress string) (string, error)
+	GetDeviceSerialNumber(basepath string, pciAddress string) (string, error)
+	GetDeviceLink(basepath string, pciAddress string) (speed string, width int)
 }
 
 type deviceUtilsHandler struct{}
@@ -112,6 +129,88 @@ func (h *deviceUtilsHandler) GetDevicePCIID(basepath string, pciAddress string)
 	return "", fmt.Errorf("no pci_id is found")
 }
 
+// GetDeviceClass gets the class code of the device without the 0x prefix,
+// e.g. 060400 for a PCI bridge
+func (h *deviceUtilsHandler) GetDeviceClass(basepath string, pciAddress string) (string, error) {
+	// #nosec No risk for path injection. Reading static path of PCI data
+	class, err := os.ReadFile(filepath.Join(basepath, pciAddress, "class"))
+	if err != nil {
+		return "", err
+	}
+	value := strings.ToLower(strings.TrimSpace(string(class)))
+	return strings.TrimPrefix(value, "0x"), nil
+}
+
+// GetDeviceSubsystemID gets the subsystem vendor:device ID of the device,
+// e.g. 1af4:1100
+func (h *deviceUtilsHandler) GetDeviceSubsystemID(basepath string, pciAddress string) (string, error) {
+	var ids []string
+	for _, name := range []string{"subsystem_vendor", "subsystem_device"} {
+		// #nosec No risk for path injection. Reading static path of PCI data
+		id, err := os.ReadFile(filepath.Join(basepath, pciAddress, name))
+		if err != nil {
+			return "", err
+		}
+		ids = append(ids, strings.TrimPrefix(strings.ToLower(strings.TrimSpace(string(id))), "0x"))
+	}
+	return strings.Join(ids, ":"), nil
+}
+
+// GetDeviceSerialNumber gets the device serial number from the extended
+// capabilities in the config space of the device, formatted like lspci does,
+// e.g. 00-1b-21-ff-ff-8a-3c-10. Empty if the device has no serial number. An
+// error is returned if the config space is truncated to its standard header,
+// as then it is unknown whether the device has a serial number.
+func (h *deviceUtilsHandler) GetDeviceSerialNumber(basepath string, pciAddress string) (string, error) {
+	// #nosec No risk for path injection. Reading static path of PCI data
+	config, err := os.ReadFile(filepath.Join(basepath, pciAddress, "config"))
+	if err != nil {
+		return "", err
+	}
+	if len(config) <= pciConfigHeaderSize {
+		return "", fmt.Errorf("config space of device %s is truncated to %d bytes, reading it needs CAP_SYS_ADMIN", pciAddress, len(config))
+	}
+
+	offset := pciExtendedCapabilitiesOffset
+	for visited := 0; offset >= pciExtendedCapabilitiesOffset && offset+12 <= len(config) && visited < 512; visited++ {
+		header := binary.LittleEndian.Uint32(config[offset:])
+		if header == 0 || header == 0xffffffff {
+			break
+		}
+		if header&0xffff == pciExtendedCapabilityDSN {
+			lower := binary.LittleEndian.Uint32(config[offset+4:])
+			upper := binary.LittleEndian.Uint32(config[offset+8:])
+			serial := make([]string, 8)
+			for i := range serial {
+				serial[i] = fmt.Sprintf("%02x", byte((uint64(upper)<<32|uint64(lower))>>(56-8*i)))
+			}
+			return strings.Join(serial, "-"), nil
+		}
+		offset = int(header >> 20)
+	}
+	return "", nil
+}
+
+// GetDeviceLink gets the negotiated PCIe link speed and width of the device,
+// e.g. 16.0 GT/s and 4. Devices that are not PCIe or whose link is down have
+// neither.
+func (h *deviceUtilsHandler) GetDeviceLink(basepath string, pciAddress string) (speed string, width int) {
+	// #nosec No risk for path injection. Reading static path of PCI data
+	speedStr, err := os.ReadFile(filepath.Join(basepath, pciAddress, "current_link_speed"))
+	if err == nil {
+		speed = strings.TrimSuffix(strings.TrimSpace(string(speedStr)), " PCIe")
+		if speed == "Unknown" {
+			speed = ""
+		}
+	}
+	// #nosec No risk for path injection. Reading static path of PCI data
+	widthStr, err := os.ReadFile(filepath.Join(basepath, pciAddress, "current_link_width"))
+	if err == nil {
+		width, _ = strconv.Atoi(strings.TrimSpace(string(widthStr)))
+	}
+	return
+}
+
 func formatVFIODeviceSpecs(devID string) []*cdispec.DeviceNode {
 	// always add /dev/vfio/vfio device as well
 	devSpecs := make([]*cdispec.DeviceNode, 0)
@@ -0,0 +1,90 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// ueventSettlePeriod batches the bursts of uevents a single rebind or
+	// hot-plug generates into one rescan.
+	ueventSettlePeriod = time.Second
+	rescanRetryPeriod  = 10 * time.Second
+)
+
+// StartDeviceWatcher re-enumerates the allocatable devices whenever the kernel
+// reports a change of a PCI device and every rescan interval, until ctx is done.
+// It fails if the kernel uevents can not be watched.
+func StartDeviceWatcher(ctx context.Context, config *Config, driver *driver) error {
+	logger := klog.LoggerWithName(klog.FromContext(ctx), "device-watcher")
+	ctx = klog.NewContext(ctx, logger)
+
+	trigger := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+
+	if config.fakeDevices == nil {
+		err := watchPCIUevents(ctx, notify)
+		if err != nil {
+			return err
+		}
+	}
+
+	var rescan <-chan time.Time
+	if config.flags.rescanInterval > 0 {
+		ticker := time.NewTicker(config.flags.rescanInterval)
+		rescan = ticker.C
+		go func() {
+			<-ctx.Done()
+			ticker.Stop()
+		}()
+	}
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-trigger:
+				time.Sleep(ueventSettlePeriod)
+				select {
+				case <-trigger:
+				default:
+				}
+				logger.V(3).Info("PCI devices changed, re-enumerating devices")
+			case <-rescan:
+				logger.V(5).Info("Periodic rescan of PCI devices")
+			}
+
+			err := driver.UpdateAllocatableDevices(ctx)
+			if err != nil {
+				logger.Error(err, "Unable to update allocatable devices, retrying", "after", rescanRetryPeriod)
+				time.AfterFunc(rescanRetryPeriod, notify)
+			}
+		}
+	}()
+
+	return nil
+}
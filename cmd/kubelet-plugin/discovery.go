@@ -17,31 +17,114 @@
 package main
 
 import (
-	"strings"
+	"context"
+	"fmt"
+	"log"
+
+	nascrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/nas/v1alpha1"
 )
 
-func enumerateAllPossibleDevices(supportedAllocatedDevices AllocatableDevices) (AllocatableDevices, error) {
-	supportedPCIDeviceMap := make(map[string]string)
-	for _, device := range supportedAllocatedDevices {
-		supportedPCIDeviceMap[strings.ToLower(device.PCIDevice.vendorSelector)] = device.PCIDevice.resourceName
+// deviceSelectors decides which devices of the node are advertised, under
+// which resource name, and which of them may be rebound to vfio-pci.
+type deviceSelectors struct {
+	selectors    []nascrd.DiscoverySelector
+	exclusions   *deviceExclusions
+	autoBindVFIO bool
+}
+
+// deviceMatch is the outcome of matching a device against deviceSelectors.
+type deviceMatch struct {
+	resourceName string
+	autoBind     bool
+	// excluded explains why the device is advertised as unavailable, if it
+	// is on an exclusion list.
+	excluded string
+}
+
+// match returns the resource name of the first selector matching the device,
+// or nil if no selector matches. A device matching selectors of several
+// resource names is only advertised under the first one. It may be rebound to
+// vfio-pci if any matching selector of that resource name asks for it and the
+// plugin allows rebinding. Devices excluded by the node or by all matching
+// selectors are matched as well, so that they can be advertised as excluded.
+func (s *deviceSelectors) match(pciAddress string, pciID string, classCode string, subsystemID string, serialNumber string) *deviceMatch {
+	var match, excluded *deviceMatch
+	for _, selector := range s.selectors {
+		if !selector.Matches(pciAddress, pciID, classCode, subsystemID) {
+			continue
+		}
+		if selector.Excludes(pciAddress, serialNumber) {
+			if excluded == nil {
+				excluded = &deviceMatch{
+					resourceName: selector.ResourceName,
+					excluded:     fmt.Sprintf("excluded by the device class parameters of %s", selector.ResourceName),
+				}
+			}
+			continue
+		}
+		if match == nil {
+			match = &deviceMatch{resourceName: selector.ResourceName}
+		}
+		if selector.ResourceName != match.resourceName {
+			log.Printf("Ignoring resource name %s for device %s, already advertised as %s", selector.ResourceName, pciAddress, match.resourceName)
+			continue
+		}
+		match.autoBind = match.autoBind || selector.AutoBindVFIO
+	}
+	if match == nil {
+		return excluded
+	}
+
+	match.autoBind = match.autoBind && s.autoBindVFIO
+	if reason := s.exclusions.excludes(pciAddress, serialNumber); reason != "" {
+		match.autoBind = false
+		match.excluded = reason
+	}
+	return match
+}
+
+// excludesSerialNumbers reports whether the node or a selector matching the
+// device excludes devices by serial number.
+func (s *deviceSelectors) excludesSerialNumbers(pciAddress string, pciID string, classCode string, subsystemID string) bool {
+	if s.exclusions != nil && len(s.exclusions.serialNumbers) > 0 {
+		return true
+	}
+	for _, selector := range s.selectors {
+		if len(selector.ExcludedSerialNumbers) > 0 && selector.Matches(pciAddress, pciID, classCode, subsystemID) {
+			return true
+		}
+	}
+	return false
+}
+
+func enumerateAllPossibleDevices(ctx context.Context, config *Config, selectors []nascrd.DiscoverySelector) (AllocatableDevices, error) {
+	exclusions, err := loadDeviceExclusions(config)
+	if err != nil {
+		return nil, err
+	}
+	supportedDevices := &deviceSelectors{
+		selectors:    selectors,
+		exclusions:   exclusions,
+		autoBindVFIO: config.flags.autoBindVFIO,
 	}
 
 	allDevices := make(AllocatableDevices)
-	discoveredDevices, err := DiscoverPermittedHostPCIDevices(supportedPCIDeviceMap)
+	var discoveredDevices []*PCIDevice
+	if config.fakeDevices != nil {
+		discoveredDevices, err = MockDiscoverPermittedHostPCIDevices(config.fakeDevices, config.flags.nasConfig.NodeName, supportedDevices)
+	} else {
+		discoveredDevices, err = DiscoverPermittedHostPCIDevices(config.flags.sysfsRoot, config.flags.nasConfig.NodeName, supportedDevices)
+	}
 	if err != nil {
 		return allDevices, err
 	}
 
-	for _, device := range supportedAllocatedDevices {
-		vendorSelector := device.PCIDevice.vendorSelector
-		if devices, supported := discoveredDevices[vendorSelector]; supported {
-			for _, discoveredDevice := range devices {
-				newDevice := &AllocatableDeviceInfo{
-					PCIDevice: discoveredDevice,
-				}
-				allDevices[newDevice.PCIDevice.uuid] = newDevice
-			}
+	for _, discoveredDevice := range discoveredDevices {
+		discoveredDevice.vendorName, discoveredDevice.deviceName = config.pciNames.Lookup(discoveredDevice.pciID)
+		newDevice := &AllocatableDeviceInfo{
+			PCIDevice: discoveredDevice,
 		}
+		allDevices[newDevice.PCIDevice.uuid] = newDevice
 	}
 
 	return allDevices, nil
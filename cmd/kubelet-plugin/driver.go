@@ -19,7 +19,9 @@ package main
 import (
 	"context"
 	"fmt"
+	"sync"
 
+	"k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/util/retry"
 	"k8s.io/klog/v2"
@@ -29,18 +31,19 @@ import (
 	clientset "kubevirt.io/dra-pci-driver/pkg/kubevirt.io/resource/clientset/versioned"
 )
 
-const (
-	//TODO , now we need to keep the name of the class parameter as this
-	pciClassParametersRefName = "pci-params"
-)
-
 var _ drapbv1.NodeServer = &driver{}
 
 type driver struct {
+	// nasLock serializes read-modify-write cycles of the NodeAllocationState.
+	nasLock   sync.Mutex
 	nascrd    *nascrd.NodeAllocationState
 	nasclient *nasclient.Client
 	state     *DeviceState
 	clientset clientset.Interface
+	config    *Config
+	// discoveryConfig is the discovery config the allocatable devices were
+	// last enumerated with.
+	discoveryConfig *nascrd.DiscoveryConfig
 }
 
 func NewDriver(ctx context.Context, config *Config) (*driver, error) {
@@ -58,16 +61,21 @@ func NewDriver(ctx context.Context, config *Config) (*driver, error) {
 			return err
 		}
 
-		supportedAllocatedDevices, err := getAllocatableDevicesFromResourceClass(ctx, config.clientSets.Example)
-		if err != nil {
-			return fmt.Errorf("error getting allocatable devices from resource class: %v", err)
-		}
+		selectors := getDiscoverySelectors(ctx, &config.nascr.Spec)
 
-		possibleDevices, err := enumerateAllPossibleDevices(supportedAllocatedDevices)
+		possibleDevices, err := enumerateAllPossibleDevices(ctx, config, selectors)
 		if err != nil {
 			return fmt.Errorf("error enumerating all possible devices: %v", err)
 		}
 
+		if migrated := migrateLegacyDeviceUUIDs(&config.nascr.Spec, possibleDevices); migrated > 0 {
+			klog.FromContext(ctx).Info("Migrated legacy device UUIDs", "count", migrated)
+		}
+
+		for _, uuid := range retainMissingDevices(possibleDevices, &config.nascr.Spec) {
+			klog.FromContext(ctx).Info("Keeping missing device that is still in use", "device", uuid)
+		}
+
 		state, err := NewDeviceState(config, possibleDevices)
 		if err != nil {
 			return err
@@ -89,10 +97,12 @@ func NewDriver(ctx context.Context, config *Config) (*driver, error) {
 		}
 
 		d = &driver{
-			nascrd:    config.nascr,
-			nasclient: client,
-			state:     state,
-			clientset: config.clientSets.Example,
+			nascrd:          config.nascr,
+			nasclient:       client,
+			state:           state,
+			clientset:       config.clientSets.Example,
+			config:          config,
+			discoveryConfig: config.nascr.Spec.DiscoveryConfig.DeepCopy(),
 		}
 
 		return nil
@@ -104,6 +114,65 @@ func NewDriver(ctx context.Context, config *Config) (*driver, error) {
 	return d, nil
 }
 
+// UpdateAllocatableDevices re-enumerates the devices selected by the discovery
+// config of the node and publishes them in the NodeAllocationState.
+func (d *driver) UpdateAllocatableDevices(ctx context.Context) error {
+	d.nasLock.Lock()
+	defer d.nasLock.Unlock()
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		err := d.nasclient.Get(ctx)
+		if err != nil {
+			return err
+		}
+
+		selectors := getDiscoverySelectors(ctx, &d.nascrd.Spec)
+
+		possibleDevices, err := enumerateAllPossibleDevices(ctx, d.config, selectors)
+		if err != nil {
+			return fmt.Errorf("error enumerating all possible devices: %v", err)
+		}
+
+		retained := d.state.UpdateAllocatable(possibleDevices, &d.nascrd.Spec)
+		for _, uuid := range retained {
+			klog.FromContext(ctx).Info("Keeping missing device that is still in use", "device", uuid)
+		}
+
+		updatedSpec, err := d.state.GetUpdatedSpec(&d.nascrd.Spec)
+		if err != nil {
+			return fmt.Errorf("error getting updated CR spec: %v", err)
+		}
+
+		if !equality.Semantic.DeepEqual(updatedSpec, &d.nascrd.Spec) {
+			err = d.nasclient.Update(ctx, updatedSpec)
+			if err != nil {
+				return err
+			}
+		}
+
+		d.discoveryConfig = updatedSpec.DiscoveryConfig.DeepCopy()
+		return nil
+	})
+}
+
+// RetryFailedResets resets the devices whose last reset failed again and
+// publishes the devices that became available.
+func (d *driver) RetryFailedResets(ctx context.Context) error {
+	if !d.state.RetryFailedResets() {
+		return nil
+	}
+	return d.UpdateAllocatableDevices(ctx)
+}
+
+// DiscoveryConfigChanged reports whether the discovery config in spec differs
+// from the one the allocatable devices were last enumerated with.
+func (d *driver) DiscoveryConfigChanged(spec *nascrd.NodeAllocationStateSpec) bool {
+	d.nasLock.Lock()
+	defer d.nasLock.Unlock()
+
+	return !equality.Semantic.DeepEqual(d.discoveryConfig, spec.DiscoveryConfig)
+}
+
 func (d *driver) Shutdown(ctx context.Context) error {
 	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
 		err := d.nasclient.Get(ctx)
@@ -133,8 +202,12 @@ func (d *driver) nodePrepareResource(ctx context.Context, claim *drapbv1.Claim)
 	logger := klog.FromContext(ctx)
 	var err error
 	var prepared []string
+
+	d.nasLock.Lock()
+	defer d.nasLock.Unlock()
+
 	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		prepared, err = d.prepare(ctx, claim.Uid)
+		prepared, err = d.prepare(ctx, claim)
 		if err != nil {
 			return fmt.Errorf("error allocating devices for claim '%v': %v", claim.Uid, err)
 		}
@@ -144,18 +217,15 @@ func (d *driver) nodePrepareResource(ctx context.Context, claim *drapbv1.Claim)
 			return fmt.Errorf("error getting updated CR spec: %v", err)
 		}
 
-		err = d.nasclient.Update(ctx, updatedSpec)
-		if err != nil {
-			if err := d.state.Unprepare(claim.Uid); err != nil {
-				logger.Error(err, "Failed to unprepare after Update", "claim", claim.Uid)
-			}
-			return err
-		}
-
-		return nil
+		// The devices stay prepared if the update fails, so that a retry
+		// after a conflict hands out the same devices without touching them.
+		return d.nasclient.Update(ctx, updatedSpec)
 	})
 
 	if err != nil {
+		if err := d.state.Rollback(claim.Uid); err != nil {
+			logger.Error(err, "Failed to roll back preparation", "claim", claim.Uid)
+		}
 		return &drapbv1.NodePrepareResourceResponse{
 			Error: fmt.Sprintf("error preparing resource: %v", err),
 		}
@@ -183,6 +253,9 @@ func (d *driver) NodeUnprepareResources(ctx context.Context, req *drapbv1.NodeUn
 }
 
 func (d *driver) nodeUnprepareResource(ctx context.Context, claim *drapbv1.Claim) *drapbv1.NodeUnprepareResourceResponse {
+	d.nasLock.Lock()
+	defer d.nasLock.Unlock()
+
 	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
 		err := d.unprepare(ctx, claim.Uid)
 		if err != nil {
@@ -211,18 +284,50 @@ func (d *driver) nodeUnprepareResource(ctx context.Context, claim *drapbv1.Claim
 	return &drapbv1.NodeUnprepareResourceResponse{}
 }
 
-func (d *driver) prepare(ctx context.Context, claimUID string) ([]string, error) {
+func (d *driver) prepare(ctx context.Context, claim *drapbv1.Claim) ([]string, error) {
 	err := d.nasclient.Get(ctx)
 	if err != nil {
 		return nil, err
 	}
-	prepared, err := d.state.Prepare(claimUID, d.nascrd.Spec.AllocatedClaims[claimUID])
+	allocation := d.nascrd.Spec.AllocatedClaims[claim.Uid]
+	err = d.checkConsumers(ctx, claim, allocation)
+	if err != nil {
+		return nil, err
+	}
+	prepared, err := d.state.Prepare(claim.Uid, allocation)
 	if err != nil {
 		return nil, err
 	}
 	return prepared, nil
 }
 
+// checkConsumers refuses to prepare a shareable claim that is reserved by
+// more pods than MaxConsumers. The scheduler adds consumers to an allocated
+// claim without involving the driver, so the limit can not be enforced when a
+// pod reserves the claim and is only checked here. Exclusive claims are not
+// checked, the scheduler never reserves them for more than one pod.
+func (d *driver) checkConsumers(ctx context.Context, claim *drapbv1.Claim, allocation nascrd.AllocatedDevices) error {
+	if allocation.Type() != nascrd.PciDeviceType {
+		return nil
+	}
+	if !allocation.Pci.Shareable || allocation.Pci.MaxConsumers == 0 {
+		return nil
+	}
+	limit := allocation.Pci.MaxConsumers
+
+	resourceClaim, err := d.config.clientSets.Core.ResourceV1alpha2().ResourceClaims(claim.Namespace).Get(ctx, claim.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to get ResourceClaim %s/%s: %v", claim.Namespace, claim.Name, err)
+	}
+	if string(resourceClaim.UID) != claim.Uid {
+		return fmt.Errorf("ResourceClaim %s/%s was replaced", claim.Namespace, claim.Name)
+	}
+	if consumers := len(resourceClaim.Status.ReservedFor); consumers > limit {
+		return fmt.Errorf("claim is reserved by %d consumers, at most %d allowed", consumers, limit)
+	}
+	return nil
+}
+
 func (d *driver) unprepare(ctx context.Context, claimUID string) error {
 	err := d.nasclient.Get(ctx)
 	if err != nil {
@@ -235,22 +340,25 @@ func (d *driver) unprepare(ctx context.Context, claimUID string) error {
 	return nil
 }
 
-// TODO: Accessing a cluster level object like ClassParameters in node-local plugin should be avoided
-// for KubeVirt usecase ,a possible solution is using a grpc server for passing  ClassParameters from controller to plugin
-func getAllocatableDevicesFromResourceClass(ctx context.Context, clientset clientset.Interface) (AllocatableDevices, error) {
-	dc, err := clientset.PciV1alpha1().DeviceClassParameters().Get(ctx, pciClassParametersRefName, metav1.GetOptions{})
-	if err != nil {
-		return nil, fmt.Errorf("error getting DeviecClassParameters called '%v': %v", pciClassParametersRefName, err)
+// getDiscoverySelectors returns the device selectors the controller published
+// for this node. The plugin never reads cluster scoped class parameters itself.
+func getDiscoverySelectors(ctx context.Context, spec *nascrd.NodeAllocationStateSpec) []nascrd.DiscoverySelector {
+	logger := klog.FromContext(ctx)
+
+	if spec.DiscoveryConfig == nil {
+		logger.Info("No discovery config published for this node yet")
+		return nil
 	}
 
-	devices := make(AllocatableDevices)
-	for _, device := range dc.Spec.DeviceSelector {
-		devices[device.PCIVendorSelector] = &AllocatableDeviceInfo{
-			PCIDevice: &PCIDevice{
-				vendorSelector: device.PCIVendorSelector,
-				resourceName:   device.ResourceName,
-			},
+	var selectors []nascrd.DiscoverySelector
+	for _, selector := range spec.DiscoveryConfig.Selectors {
+		selector = *selector.DeepCopy()
+		if err := selector.Validate(); err != nil {
+			logger.Info("Ignoring invalid discovery selector", "resourceName", selector.ResourceName, "error", err)
+			continue
 		}
+		selector.Normalize()
+		selectors = append(selectors, selector)
 	}
-	return devices, nil
+	return selectors
 }
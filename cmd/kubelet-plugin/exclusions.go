@@ -0,0 +1,149 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+
+	nascrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/nas/v1alpha1"
+	pcicrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/v1alpha1"
+)
+
+// ExcludedDevices lists the devices of a node that must never be advertised.
+// It is read from a YAML or JSON file local to the node, e.g.:
+//
+//	pciAddresses:
+//	- "0000:00:1f.2"
+//	serialNumbers:
+//	- "00-1b-21-ff-ff-8a-3c-10"
+type ExcludedDevices struct {
+	PCIAddresses  []string `json:"pciAddresses,omitempty"`
+	SerialNumbers []string `json:"serialNumbers,omitempty"`
+}
+
+// deviceExclusions maps the excluded PCI addresses and serial numbers of the
+// node to where they were excluded.
+type deviceExclusions struct {
+	addresses     map[string]string
+	serialNumbers map[string]string
+}
+
+// loadDeviceExclusions collects the devices excluded on this node by the
+// local exclusion file and by the excluded-devices annotation of the node.
+// Both are read on every discovery, so that changes take effect without a
+// restart of the plugin. The node is read from the cache of the node
+// informer.
+func loadDeviceExclusions(config *Config) (*deviceExclusions, error) {
+	exclusions := &deviceExclusions{
+		addresses:     make(map[string]string),
+		serialNumbers: make(map[string]string),
+	}
+
+	if config.flags.excludedDevicesFile != "" {
+		// #nosec No risk for path injection. The path is provided by the administrator.
+		data, err := os.ReadFile(config.flags.excludedDevicesFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read excluded devices file: %v", err)
+		}
+		excluded := &ExcludedDevices{}
+		err = yaml.UnmarshalStrict(data, excluded)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse excluded devices file: %v", err)
+		}
+		source := fmt.Sprintf("excluded by file %s", config.flags.excludedDevicesFile)
+		for _, address := range excluded.PCIAddresses {
+			err := exclusions.addAddress(address, source)
+			if err != nil {
+				return nil, fmt.Errorf("invalid excluded devices file: %v", err)
+			}
+		}
+		for _, serialNumber := range excluded.SerialNumbers {
+			err := exclusions.addSerialNumber(serialNumber, source)
+			if err != nil {
+				return nil, fmt.Errorf("invalid excluded devices file: %v", err)
+			}
+		}
+	}
+
+	node, err := config.nodeLister.Get(config.flags.nasConfig.NodeName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get node %s: %v", config.flags.nasConfig.NodeName, err)
+	}
+	source := fmt.Sprintf("excluded by node annotation %s", pcicrd.NodeExcludedDevicesAnnotation)
+	err = exclusions.addAnnotation(node.Annotations[pcicrd.NodeExcludedDevicesAnnotation], source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node annotation %s: %v", pcicrd.NodeExcludedDevicesAnnotation, err)
+	}
+
+	return exclusions, nil
+}
+
+// addAnnotation adds the comma separated PCI addresses and serial numbers of
+// the excluded-devices annotation. Entries that are neither are rejected
+// rather than ignored, so that a typo does not leave a device unprotected.
+func (e *deviceExclusions) addAnnotation(annotation string, source string) error {
+	for _, entry := range strings.Split(annotation, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if e.addAddress(entry, source) == nil {
+			continue
+		}
+		if e.addSerialNumber(entry, source) != nil {
+			return fmt.Errorf("%q is neither a PCI address nor a device serial number", entry)
+		}
+	}
+	return nil
+}
+
+func (e *deviceExclusions) addAddress(address string, source string) error {
+	domain, bus, slot, function, err := parsePCIAddress(address)
+	if err != nil {
+		return err
+	}
+	e.addresses[fmt.Sprintf("%04x:%02x:%02x.%x", domain, bus, slot, function)] = source
+	return nil
+}
+
+func (e *deviceExclusions) addSerialNumber(serialNumber string, source string) error {
+	err := nascrd.ValidateSerialNumber(serialNumber)
+	if err != nil {
+		return err
+	}
+	e.serialNumbers[strings.ToLower(serialNumber)] = source
+	return nil
+}
+
+// excludes returns why the device at pciAddress with the given serial number
+// is excluded on this node, or an empty string if it is not.
+func (e *deviceExclusions) excludes(pciAddress string, serialNumber string) string {
+	if e == nil {
+		return ""
+	}
+	if source, excluded := e.addresses[strings.ToLower(pciAddress)]; excluded {
+		return source
+	}
+	if serialNumber == "" {
+		return ""
+	}
+	return e.serialNumbers[strings.ToLower(serialNumber)]
+}
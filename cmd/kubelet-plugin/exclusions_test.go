@@ -0,0 +1,78 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAddExcludedDevicesAnnotation(t *testing.T) {
+	tests := []struct {
+		name              string
+		annotation        string
+		wantAddresses     map[string]string
+		wantSerialNumbers map[string]string
+		wantErr           bool
+	}{
+		{
+			name:              "addresses and serial numbers",
+			annotation:        "0000:00:07.0, 00:1f.2,00-1B-21-FF-FF-8A-3C-10,",
+			wantAddresses:     map[string]string{"0000:00:07.0": "annotation", "0000:00:1f.2": "annotation"},
+			wantSerialNumbers: map[string]string{"00-1b-21-ff-ff-8a-3c-10": "annotation"},
+		},
+		{
+			name:              "empty",
+			wantAddresses:     map[string]string{},
+			wantSerialNumbers: map[string]string{},
+		},
+		{
+			name:       "neither address nor serial number",
+			annotation: "0000:00:07.0,boot-disk",
+			wantErr:    true,
+		},
+		{
+			name:       "serial number without dashes",
+			annotation: "001b21ffff8a3c10",
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exclusions := &deviceExclusions{
+				addresses:     make(map[string]string),
+				serialNumbers: make(map[string]string),
+			}
+			err := exclusions.addAnnotation(tt.annotation, "annotation")
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("addAnnotation(%q) succeeded, want error", tt.annotation)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("addAnnotation(%q) = %v, want no error", tt.annotation, err)
+			}
+			if !reflect.DeepEqual(exclusions.addresses, tt.wantAddresses) {
+				t.Errorf("addresses = %v, want %v", exclusions.addresses, tt.wantAddresses)
+			}
+			if !reflect.DeepEqual(exclusions.serialNumbers, tt.wantSerialNumbers) {
+				t.Errorf("serial numbers = %v, want %v", exclusions.serialNumbers, tt.wantSerialNumbers)
+			}
+		})
+	}
+}
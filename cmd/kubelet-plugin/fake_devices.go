@@ -0,0 +1,133 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// FakeDevice describes a single PCI device served in fake-devices mode.
+type FakeDevice struct {
+	PciAddress string `json:"pciAddress"`
+	PciID      string `json:"pciID"`
+	IOMMUGroup string `json:"iommuGroup"`
+	// NumaNode is the NUMA node of the device, unknown if omitted.
+	NumaNode *int   `json:"numaNode,omitempty"`
+	Driver   string `json:"driver,omitempty"`
+	// Class is the class code of the device, e.g. 010802.
+	Class string `json:"class,omitempty"`
+	// SubsystemID is the subsystem vendor:device ID of the device.
+	SubsystemID string `json:"subsystemID,omitempty"`
+	// SerialNumber is the device serial number of the device, e.g.
+	// 00-1b-21-ff-ff-8a-3c-10.
+	SerialNumber string `json:"serialNumber,omitempty"`
+	// LinkSpeed and LinkWidth are the negotiated PCIe link speed and width
+	// of the device, e.g. "16.0 GT/s" and 4.
+	LinkSpeed string `json:"linkSpeed,omitempty"`
+	LinkWidth int    `json:"linkWidth,omitempty"`
+	// ResetFails makes every reset of the device fail.
+	ResetFails bool `json:"resetFails,omitempty"`
+	// UpstreamBridges are the addresses of the PCI bridges above the device,
+	// starting with the root port.
+	UpstreamBridges []string `json:"upstreamBridges,omitempty"`
+}
+
+// FakeDeviceInventory is the set of PCI devices served in fake-devices mode.
+// It is read from a YAML or JSON file, e.g.:
+//
+//	devices:
+//	- pciAddress: "0000:00:07.0"
+//	  pciID: "1b36:0010"
+//	  iommuGroup: "7"
+//	  numaNode: 0
+type FakeDeviceInventory struct {
+	Devices []FakeDevice `json:"devices"`
+}
+
+// LoadFakeDeviceInventory reads and validates the inventory at path.
+func LoadFakeDeviceInventory(path string) (*FakeDeviceInventory, error) {
+	// #nosec No risk for path injection. The path is provided by the administrator.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read fake device inventory: %v", err)
+	}
+
+	inventory := &FakeDeviceInventory{}
+	err = yaml.UnmarshalStrict(data, inventory)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse fake device inventory: %v", err)
+	}
+
+	addresses := make(map[string]struct{})
+	for i := range inventory.Devices {
+		device := &inventory.Devices[i]
+		device.PciAddress = strings.ToLower(device.PciAddress)
+		device.PciID = strings.ToLower(device.PciID)
+		device.Class = strings.TrimPrefix(strings.ToLower(device.Class), "0x")
+		device.SubsystemID = strings.ToLower(device.SubsystemID)
+		device.SerialNumber = strings.ToLower(device.SerialNumber)
+		if device.Driver == "" {
+			device.Driver = vfioPCIDriver
+		}
+
+		if _, _, _, _, err := parsePCIAddress(device.PciAddress); err != nil {
+			return nil, fmt.Errorf("invalid fake device %d: %v", i, err)
+		}
+		if _, exists := addresses[device.PciAddress]; exists {
+			return nil, fmt.Errorf("invalid fake device %d: duplicate PCI address %s", i, device.PciAddress)
+		}
+		addresses[device.PciAddress] = struct{}{}
+
+		if len(strings.Split(device.PciID, ":")) != 2 {
+			return nil, fmt.Errorf("invalid fake device %d: malformed vendor:device ID %q", i, device.PciID)
+		}
+		if device.SubsystemID != "" && len(strings.Split(device.SubsystemID, ":")) != 2 {
+			return nil, fmt.Errorf("invalid fake device %d: malformed subsystem ID %q", i, device.SubsystemID)
+		}
+		if device.IOMMUGroup == "" {
+			return nil, fmt.Errorf("invalid fake device %d: missing IOMMU group", i)
+		}
+
+		for j, bridge := range device.UpstreamBridges {
+			device.UpstreamBridges[j] = strings.ToLower(bridge)
+			if _, _, _, _, err := parsePCIAddress(bridge); err != nil {
+				return nil, fmt.Errorf("invalid fake device %d: upstream bridge: %v", i, err)
+			}
+		}
+	}
+
+	return inventory, nil
+}
+
+// fakeRootComplex names the root complex of a fake device after the domain and
+// bus of its root port, or of the device itself if it has no upstream bridges,
+// the way the kernel names PCI host bridges.
+func fakeRootComplex(device FakeDevice) string {
+	address := device.PciAddress
+	if len(device.UpstreamBridges) > 0 {
+		address = device.UpstreamBridges[0]
+	}
+	domain, bus, _, _, err := parsePCIAddress(address)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("pci%04x:%02x", domain, bus)
+}
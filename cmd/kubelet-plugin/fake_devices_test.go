@@ -0,0 +1,66 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	nascrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/nas/v1alpha1"
+)
+
+func TestFakeDeviceNUMANode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fake-devices.yaml")
+	err := os.WriteFile(path, []byte(`devices:
+- pciAddress: "0000:00:07.0"
+  pciID: "1b36:0010"
+  iommuGroup: "7"
+- pciAddress: "0000:00:08.0"
+  pciID: "1b36:0010"
+  iommuGroup: "8"
+  numaNode: 0
+`), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	inventory, err := LoadFakeDeviceInventory(path)
+	if err != nil {
+		t.Fatalf("LoadFakeDeviceInventory: %v", err)
+	}
+
+	selectors := &deviceSelectors{
+		selectors: []nascrd.DiscoverySelector{{ResourceName: "nvme", PCISelector: nascrd.PCISelector{PCIVendorSelector: "1b36:0010"}}},
+	}
+	devices, err := MockDiscoverPermittedHostPCIDevices(inventory, "node01", selectors)
+	if err != nil {
+		t.Fatalf("MockDiscoverPermittedHostPCIDevices: %v", err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("discovered %d fake devices, want 2", len(devices))
+	}
+	got := make(map[string]int)
+	for _, device := range devices {
+		got[device.pciAddress] = device.numaNode
+	}
+	want := map[string]int{"0000:00:07.0": -1, "0000:00:08.0": 0}
+	for address, numaNode := range want {
+		if got[address] != numaNode {
+			t.Errorf("device %s is on NUMA node %d, want %d", address, got[address], numaNode)
+		}
+	}
+}
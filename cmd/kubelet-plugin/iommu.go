@@ -0,0 +1,112 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	iommuGroupsPath = "kernel/iommu_groups"
+
+	// pciBridgeClassPrefix is the base class and subclass of PCI-to-PCI
+	// bridges, which VFIO tolerates in a group regardless of their driver.
+	pciBridgeClassPrefix = "0604"
+)
+
+// viableGroupDrivers are the drivers VFIO accepts for the members of an IOMMU
+// group that is opened by a VM.
+var viableGroupDrivers = map[string]struct{}{
+	vfioPCIDriver: {},
+	"pci-stub":    {},
+}
+
+// checkIOMMUGroupViability inspects every member of the IOMMU group of the
+// device at pciAddress and describes the first one that prevents VFIO from
+// opening the group. An empty string means that the group is viable. Members
+// that selectors allow to be rebound are advertised themselves and, as devices
+// sharing a group are allocated together, rebound to vfio-pci along with the
+// device.
+func checkIOMMUGroupViability(sysfsRoot string, pciAddress string, iommuGroup string, selectors *deviceSelectors) (string, error) {
+	pciBasePath := filepath.Join(sysfsRoot, pciDevicesPath)
+	groupPath := filepath.Join(sysfsRoot, iommuGroupsPath, iommuGroup, "devices")
+
+	members, err := os.ReadDir(groupPath)
+	if err != nil {
+		return "", fmt.Errorf("unable to list members of IOMMU group %s: %v", iommuGroup, err)
+	}
+
+	for _, member := range members {
+		address := member.Name()
+		if address == pciAddress {
+			continue
+		}
+
+		if _, err := os.Lstat(filepath.Join(pciBasePath, address, "driver")); os.IsNotExist(err) {
+			continue
+		}
+		driver, err := Handler.GetDeviceDriver(pciBasePath, address)
+		if err != nil {
+			return "", err
+		}
+		if _, viable := viableGroupDrivers[driver]; viable {
+			continue
+		}
+
+		class, err := Handler.GetDeviceClass(pciBasePath, address)
+		if err == nil && strings.HasPrefix(class, pciBridgeClassPrefix) {
+			continue
+		}
+
+		pciID, err := Handler.GetDevicePCIID(pciBasePath, address)
+		if err == nil {
+			subsystemID, _ := Handler.GetDeviceSubsystemID(pciBasePath, address)
+			serialNumber, err := Handler.GetDeviceSerialNumber(pciBasePath, address)
+			match := selectors.match(address, pciID, class, subsystemID, serialNumber)
+			// A member whose serial number may be excluded is not rebound.
+			unchecked := err != nil && selectors.excludesSerialNumbers(address, pciID, class, subsystemID)
+			if match != nil && match.autoBind && !unchecked {
+				continue
+			}
+		}
+
+		return fmt.Sprintf("IOMMU group %s member %s is bound to %s", iommuGroup, address, driver), nil
+	}
+
+	return "", nil
+}
+
+// checkFakeIOMMUGroupViability is the counterpart of checkIOMMUGroupViability
+// for the devices of a fake device inventory.
+func checkFakeIOMMUGroupViability(inventory *FakeDeviceInventory, device FakeDevice, selectors *deviceSelectors) string {
+	for _, member := range inventory.Devices {
+		if member.IOMMUGroup != device.IOMMUGroup || member.PciAddress == device.PciAddress {
+			continue
+		}
+		if _, viable := viableGroupDrivers[member.Driver]; viable || member.Driver == "" {
+			continue
+		}
+		if match := selectors.match(member.PciAddress, member.PciID, member.Class, member.SubsystemID, member.SerialNumber); match != nil && match.autoBind {
+			continue
+		}
+		return fmt.Sprintf("IOMMU group %s member %s is bound to %s", device.IOMMUGroup, member.PciAddress, member.Driver)
+	}
+	return ""
+}
@@ -22,9 +22,12 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/urfave/cli/v2"
 
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
 	plugin "k8s.io/dynamic-resource-allocation/kubeletplugin"
 	"k8s.io/klog/v2"
 
@@ -47,7 +50,15 @@ type Flags struct {
 	nasConfig        flags.NasConfig
 	loggingConfig    *flags.LoggingConfig
 
-	cdiRoot string
+	cdiRoot        string
+	sysfsRoot      string
+	fakeDevices    string
+	rescanInterval time.Duration
+	autoBindVFIO   bool
+	deviceReset    bool
+
+	excludedDevicesFile string
+	pciIDs              string
 }
 
 type Config struct {
@@ -55,6 +66,10 @@ type Config struct {
 	nascr         *nascrd.NodeAllocationState
 	exampleclient exampleclientset.Interface
 	clientSets    flags.ClientSets
+	fakeDevices   *FakeDeviceInventory
+	pciNames      *PCINames
+	nodeInformer  cache.SharedIndexInformer
+	nodeLister    corev1listers.NodeLister
 }
 
 func main() {
@@ -76,6 +91,52 @@ func newApp() *cli.App {
 			Destination: &flags.cdiRoot,
 			EnvVars:     []string{"CDI_ROOT"},
 		},
+		&cli.StringFlag{
+			Name:        "sysfs-root",
+			Usage:       "Absolute path to the root of the sysfs tree used to discover PCI devices.",
+			Value:       "/sys",
+			Destination: &flags.sysfsRoot,
+			EnvVars:     []string{"SYSFS_ROOT"},
+		},
+		&cli.StringFlag{
+			Name:        "fake-devices",
+			Usage:       "Path to a YAML or JSON `file` listing fake PCI devices to serve instead of the devices found in sysfs. No VFIO device nodes are injected into containers in this mode.",
+			Destination: &flags.fakeDevices,
+			EnvVars:     []string{"FAKE_DEVICES"},
+		},
+		&cli.DurationFlag{
+			Name:        "rescan-interval",
+			Usage:       "Interval at which PCI devices are rediscovered in addition to rediscovery on kernel uevents. Zero disables periodic rescans.",
+			Value:       time.Minute,
+			Destination: &flags.rescanInterval,
+			EnvVars:     []string{"RESCAN_INTERVAL"},
+		},
+		&cli.BoolFlag{
+			Name:        "auto-bind-vfio",
+			Usage:       "Rebind devices selected with autoBindVFIO from their host driver to vfio-pci when a claim is prepared, and back when it is unprepared. Requires write access to sysfs.",
+			Destination: &flags.autoBindVFIO,
+			EnvVars:     []string{"AUTO_BIND_VFIO"},
+		},
+		&cli.BoolFlag{
+			Name:        "device-reset",
+			Usage:       "Reset devices through sysfs when a claim is unprepared. Devices whose reset fails are not handed out again until a later reset succeeds.",
+			Value:       true,
+			Destination: &flags.deviceReset,
+			EnvVars:     []string{"DEVICE_RESET"},
+		},
+		&cli.StringFlag{
+			Name:        "excluded-devices-file",
+			Usage:       "Path to a YAML or JSON `file` listing the PCI addresses and serial numbers of devices of this node that must never be advertised, e.g. its boot disk.",
+			Destination: &flags.excludedDevicesFile,
+			EnvVars:     []string{"EXCLUDED_DEVICES_FILE"},
+		},
+		&cli.StringFlag{
+			Name:        "pci-ids",
+			Usage:       "Path to the PCI ID database `file` used to publish vendor and device names.",
+			Value:       "/usr/share/misc/pci.ids",
+			Destination: &flags.pciIDs,
+			EnvVars:     []string{"PCI_IDS"},
+		},
 	}
 	cliFlags = append(cliFlags, flags.kubeClientConfig.Flags()...)
 	cliFlags = append(cliFlags, flags.nasConfig.Flags()...)
@@ -112,6 +173,19 @@ func newApp() *cli.App {
 				clientSets:    clientSets,
 			}
 
+			if flags.fakeDevices != "" {
+				config.fakeDevices, err = LoadFakeDeviceInventory(flags.fakeDevices)
+				if err != nil {
+					return fmt.Errorf("load fake devices: %v", err)
+				}
+				klog.FromContext(ctx).Info("Serving fake PCI devices", "file", flags.fakeDevices, "numDevices", len(config.fakeDevices.Devices))
+			}
+
+			config.pciNames, err = LoadPCINames(flags.pciIDs)
+			if err != nil {
+				klog.FromContext(ctx).Info("Not publishing vendor and device names", "error", err)
+			}
+
 			return StartPlugin(ctx, config)
 		},
 	}
@@ -138,11 +212,27 @@ func StartPlugin(ctx context.Context, config *Config) error {
 		return fmt.Errorf("path for cdi file generation is not a directory: '%v'", err)
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	err = StartNodeInformer(ctx, config)
+	if err != nil {
+		return fmt.Errorf("start node informer: %v", err)
+	}
+
 	driver, err := NewDriver(ctx, config)
 	if err != nil {
 		return err
 	}
 
+	StartNasWatcher(ctx, config, driver)
+	StartNodeWatcher(ctx, config, driver)
+	err = StartDeviceWatcher(ctx, config, driver)
+	if err != nil {
+		return fmt.Errorf("start device watcher: %v", err)
+	}
+	StartResetRetrier(ctx, driver)
+
 	dp, err := plugin.Start(
 		driver,
 		plugin.DriverName(DriverName),
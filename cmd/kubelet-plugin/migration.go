@@ -0,0 +1,95 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"strings"
+
+	nascrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/nas/v1alpha1"
+)
+
+// migrateLegacyDeviceUUIDs rewrites the device UUIDs referenced by the allocated
+// and prepared claims in spec so that they match the UUIDs of the discovered
+// devices. Earlier versions of the plugin assigned a random UUID to every device
+// on each start; the PCI address published next to each of those UUIDs in
+// AllocatableDevices is used to map them onto the deterministic ones. It
+// returns the number of device references that were rewritten.
+func migrateLegacyDeviceUUIDs(spec *nascrd.NodeAllocationStateSpec, devices AllocatableDevices) int {
+	uuidByAddress := make(map[string]string)
+	for _, device := range devices {
+		uuidByAddress[strings.ToLower(device.pciAddress)] = device.uuid
+	}
+
+	remap := make(map[string]string)
+	for _, device := range spec.AllocatableDevices {
+		if device.Type() != nascrd.PciDeviceType {
+			continue
+		}
+		newUUID, exists := uuidByAddress[strings.ToLower(device.Pci.PciAddress)]
+		if !exists || newUUID == device.Pci.UUID {
+			continue
+		}
+		remap[device.Pci.UUID] = newUUID
+	}
+
+	if len(remap) == 0 {
+		return 0
+	}
+
+	migrated := 0
+	for _, allocation := range spec.AllocatedClaims {
+		if allocation.Type() != nascrd.PciDeviceType {
+			continue
+		}
+		for i, device := range allocation.Pci.Devices {
+			if newUUID, exists := remap[device.UUID]; exists {
+				allocation.Pci.Devices[i].UUID = newUUID
+				migrated++
+			}
+		}
+	}
+
+	for _, prepared := range spec.PreparedClaims {
+		if prepared.Type() != nascrd.PciDeviceType {
+			continue
+		}
+		for i, device := range prepared.Pci.Devices {
+			if newUUID, exists := remap[device.UUID]; exists {
+				prepared.Pci.Devices[i].UUID = newUUID
+				migrated++
+			}
+		}
+	}
+
+	for i, device := range spec.AllocatableDevices {
+		if device.Type() != nascrd.PciDeviceType {
+			continue
+		}
+		if newUUID, exists := remap[device.Pci.UUID]; exists {
+			spec.AllocatableDevices[i].Pci.UUID = newUUID
+		}
+	}
+
+	for oldUUID, newUUID := range remap {
+		if released, exists := spec.DeviceReleaseTimes[oldUUID]; exists {
+			delete(spec.DeviceReleaseTimes, oldUUID)
+			spec.DeviceReleaseTimes[newUUID] = released
+		}
+	}
+
+	return migrated
+}
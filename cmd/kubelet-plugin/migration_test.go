@@ -0,0 +1,124 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	nascrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/nas/v1alpha1"
+)
+
+func discoveredDevices(t *testing.T, addresses ...string) AllocatableDevices {
+	t.Helper()
+	devices := make(AllocatableDevices)
+	for _, address := range addresses {
+		uuid, err := GenerateDeviceUUID("node01", address)
+		if err != nil {
+			t.Fatalf("GenerateDeviceUUID: %v", err)
+		}
+		devices[uuid] = &AllocatableDeviceInfo{
+			PCIDevice: &PCIDevice{uuid: uuid, pciAddress: address},
+		}
+	}
+	return devices
+}
+
+func uuidOf(t *testing.T, devices AllocatableDevices, address string) string {
+	t.Helper()
+	for uuid, device := range devices {
+		if device.pciAddress == address {
+			return uuid
+		}
+	}
+	t.Fatalf("no device at %s", address)
+	return ""
+}
+
+func TestMigrateLegacyDeviceUUIDs(t *testing.T) {
+	devices := discoveredDevices(t, "0000:00:07.0", "0000:00:0a.0")
+	uuid7 := uuidOf(t, devices, "0000:00:07.0")
+	uuid10 := uuidOf(t, devices, "0000:00:0a.0")
+
+	spec := &nascrd.NodeAllocationStateSpec{
+		AllocatableDevices: []nascrd.AllocatableDevice{
+			{Pci: &nascrd.AllocatablePci{UUID: "legacy-7", PciAddress: "0000:00:07.0"}},
+			// Published with a different spelling by an older plugin.
+			{Pci: &nascrd.AllocatablePci{UUID: "legacy-10", PciAddress: "0000:00:0A.0"}},
+			// Gone from the node, nothing to map it to.
+			{Pci: &nascrd.AllocatablePci{UUID: "legacy-9", PciAddress: "0000:00:09.0"}},
+		},
+		AllocatedClaims: map[string]nascrd.AllocatedDevices{
+			"claim-a": {Pci: &nascrd.AllocatedPcis{Devices: []nascrd.AllocatedPci{{UUID: "legacy-7"}, {UUID: "legacy-10"}}}},
+			"claim-b": {Pci: &nascrd.AllocatedPcis{Devices: []nascrd.AllocatedPci{{UUID: "legacy-9"}}}},
+		},
+		PreparedClaims: map[string]nascrd.PreparedDevices{
+			"claim-a": {Pci: &nascrd.PreparedPcis{Devices: []nascrd.PreparedPci{{UUID: "legacy-7"}, {UUID: "legacy-10", HostDriver: "nvme"}}}},
+		},
+	}
+
+	migrated := migrateLegacyDeviceUUIDs(spec, devices)
+	if migrated != 4 {
+		t.Errorf("migrateLegacyDeviceUUIDs() = %d, want 4 rewritten references", migrated)
+	}
+
+	wantAllocatable := []string{uuid7, uuid10, "legacy-9"}
+	var gotAllocatable []string
+	for _, device := range spec.AllocatableDevices {
+		gotAllocatable = append(gotAllocatable, device.Pci.UUID)
+	}
+	if !reflect.DeepEqual(gotAllocatable, wantAllocatable) {
+		t.Errorf("AllocatableDevices UUIDs = %v, want %v", gotAllocatable, wantAllocatable)
+	}
+
+	wantAllocated := map[string]nascrd.AllocatedDevices{
+		"claim-a": {Pci: &nascrd.AllocatedPcis{Devices: []nascrd.AllocatedPci{{UUID: uuid7}, {UUID: uuid10}}}},
+		"claim-b": {Pci: &nascrd.AllocatedPcis{Devices: []nascrd.AllocatedPci{{UUID: "legacy-9"}}}},
+	}
+	if !reflect.DeepEqual(spec.AllocatedClaims, wantAllocated) {
+		t.Errorf("AllocatedClaims = %+v, want %+v", spec.AllocatedClaims, wantAllocated)
+	}
+
+	wantPrepared := map[string]nascrd.PreparedDevices{
+		"claim-a": {Pci: &nascrd.PreparedPcis{Devices: []nascrd.PreparedPci{{UUID: uuid7}, {UUID: uuid10, HostDriver: "nvme"}}}},
+	}
+	if !reflect.DeepEqual(spec.PreparedClaims, wantPrepared) {
+		t.Errorf("PreparedClaims = %+v, want %+v", spec.PreparedClaims, wantPrepared)
+	}
+}
+
+func TestMigrateLegacyDeviceUUIDsIsIdempotent(t *testing.T) {
+	devices := discoveredDevices(t, "0000:00:07.0")
+	uuid7 := uuidOf(t, devices, "0000:00:07.0")
+
+	spec := &nascrd.NodeAllocationStateSpec{
+		AllocatableDevices: []nascrd.AllocatableDevice{
+			{Pci: &nascrd.AllocatablePci{UUID: uuid7, PciAddress: "0000:00:07.0"}},
+		},
+		AllocatedClaims: map[string]nascrd.AllocatedDevices{
+			"claim-a": {Pci: &nascrd.AllocatedPcis{Devices: []nascrd.AllocatedPci{{UUID: uuid7}}}},
+		},
+	}
+	want := spec.DeepCopy()
+
+	if migrated := migrateLegacyDeviceUUIDs(spec, devices); migrated != 0 {
+		t.Errorf("migrateLegacyDeviceUUIDs() = %d, want 0", migrated)
+	}
+	if !reflect.DeepEqual(spec, want) {
+		t.Errorf("spec changed to %+v, want %+v", spec, want)
+	}
+}
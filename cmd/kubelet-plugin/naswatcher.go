@@ -0,0 +1,102 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	nascrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/nas/v1alpha1"
+)
+
+const (
+	discoveryConfigRetryPeriod = 10 * time.Second
+)
+
+// StartNasWatcher watches the NodeAllocationState of this node and
+// re-enumerates the allocatable devices whenever the controller publishes a new
+// discovery config, until ctx is done. Only the node's own object is read.
+func StartNasWatcher(ctx context.Context, config *Config, driver *driver) {
+	logger := klog.LoggerWithName(klog.FromContext(ctx), "nas-watcher")
+	ctx = klog.NewContext(ctx, logger)
+
+	trigger := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+	onChange := func(obj interface{}) {
+		nas, ok := obj.(*nascrd.NodeAllocationState)
+		if ok && driver.DiscoveryConfigChanged(&nas.Spec) {
+			notify()
+		}
+	}
+
+	nasClient := config.clientSets.Example.NasV1alpha1().NodeAllocationStates(config.nascr.Namespace)
+	fieldSelector := fields.OneTermEqualSelector("metadata.name", config.nascr.Name).String()
+	informer := cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				options.FieldSelector = fieldSelector
+				return nasClient.List(ctx, options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				options.FieldSelector = fieldSelector
+				return nasClient.Watch(ctx, options)
+			},
+		},
+		&nascrd.NodeAllocationState{},
+		0, /* resync period */
+		cache.Indexers{},
+	)
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    onChange,
+		UpdateFunc: func(oldObj, newObj interface{}) { onChange(newObj) },
+	})
+	if err != nil {
+		logger.Error(err, "Unable to watch NodeAllocationState")
+		return
+	}
+
+	go informer.Run(ctx.Done())
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-trigger:
+			}
+
+			logger.Info("Discovery config changed, re-enumerating devices")
+			err := driver.UpdateAllocatableDevices(ctx)
+			if err != nil {
+				logger.Error(err, "Unable to update allocatable devices, retrying", "after", discoveryConfigRetryPeriod)
+				time.AfterFunc(discoveryConfigRetryPeriod, notify)
+			}
+		}
+	}()
+}
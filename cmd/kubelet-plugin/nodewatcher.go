@@ -0,0 +1,113 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	pcicrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/v1alpha1"
+)
+
+const (
+	nodeExclusionsRetryPeriod = 10 * time.Second
+)
+
+// StartNodeInformer caches the Node object of this node, so that discovery
+// reads its annotations without a request to the API server. It returns once
+// the cache is filled.
+func StartNodeInformer(ctx context.Context, config *Config) error {
+	fieldSelector := fields.OneTermEqualSelector("metadata.name", config.flags.nasConfig.NodeName).String()
+	factory := informers.NewSharedInformerFactoryWithOptions(
+		config.clientSets.Core,
+		0, /* resync period */
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fieldSelector
+		}),
+	)
+	nodes := factory.Core().V1().Nodes()
+	config.nodeInformer = nodes.Informer()
+	config.nodeLister = nodes.Lister()
+
+	factory.Start(ctx.Done())
+	for informer, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return fmt.Errorf("unable to sync informer for %v", informer)
+		}
+	}
+	return nil
+}
+
+// StartNodeWatcher re-enumerates the allocatable devices whenever the
+// excluded-devices annotation of this node changes, until ctx is done.
+func StartNodeWatcher(ctx context.Context, config *Config, driver *driver) {
+	logger := klog.LoggerWithName(klog.FromContext(ctx), "node-watcher")
+	ctx = klog.NewContext(ctx, logger)
+
+	trigger := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+
+	_, err := config.nodeInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNode, ok := oldObj.(*corev1.Node)
+			if !ok {
+				return
+			}
+			newNode, ok := newObj.(*corev1.Node)
+			if !ok {
+				return
+			}
+			if oldNode.Annotations[pcicrd.NodeExcludedDevicesAnnotation] != newNode.Annotations[pcicrd.NodeExcludedDevicesAnnotation] {
+				notify()
+			}
+		},
+	})
+	if err != nil {
+		logger.Error(err, "Unable to watch Node")
+		return
+	}
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-trigger:
+			}
+
+			logger.Info("Excluded devices of node changed, re-enumerating devices")
+			err := driver.UpdateAllocatableDevices(ctx)
+			if err != nil {
+				logger.Error(err, "Unable to update allocatable devices, retrying", "after", nodeExclusionsRetryPeriod)
+				time.AfterFunc(nodeExclusionsRetryPeriod, notify)
+			}
+		}
+	}()
+}
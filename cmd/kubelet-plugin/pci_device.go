@@ -17,36 +17,113 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
-	"github.com/google/uuid"
+	nascrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/nas/v1alpha1"
+	"kubevirt.io/dra-pci-driver/pkg/util"
 )
 
 const (
-	pciBasePath       = "/sys/bus/pci/devices"
+	pciDevicesPath    = "bus/pci/devices"
+	pciDriversPath    = "bus/pci/drivers"
+	vfioPCIDriver     = "vfio-pci"
 	PCIResourcePrefix = "PCI_RESOURCE"
 )
 
 type PCIDevice struct {
-	uuid           string
-	vendorSelector string
-	resourceName   string
-	pciAddress     string
-	driver         string
-	iommuGroup     string
-	numaNode       int
-	pciID          string
+	uuid         string
+	resourceName string
+	pciAddress   string
+	driver       string
+	iommuGroup   string
+	numaNode     int
+	pciID        string
+	classCode    string
+	subsystemID  string
+	serialNumber string
+	vendorName   string
+	deviceName   string
+	linkSpeed    string
+	linkWidth    int
+	// rootComplex and upstreamBridges locate the device in the PCIe
+	// hierarchy, see getDeviceTopology.
+	rootComplex     string
+	upstreamBridges []string
+	// unavailableReason is set when the device can not be handed out, e.g.
+	// because it disappeared from the node while still in use.
+	unavailableReason  string
+	unavailableMessage string
+	// autoBind is set when the device may be rebound from its host driver to
+	// vfio-pci when it is prepared.
+	autoBind bool
+	// hostDriver is the driver the device was bound to before it was rebound
+	// to vfio-pci. It is only set on prepared devices.
+	hostDriver string
 }
 
-func DiscoverPermittedHostPCIDevices(supportedPCIDeviceMap map[string]string) (map[string][]*PCIDevice, error) {
+// GenerateDeviceUUID derives a stable UUID for a PCI device from the node name
+// and the device's domain, bus, slot and function, so that the same device keeps
+// its identity across plugin restarts and node reboots.
+func GenerateDeviceUUID(nodeName string, pciAddress string) (string, error) {
+	domain, bus, slot, function, err := parsePCIAddress(pciAddress)
+	if err != nil {
+		return "", err
+	}
+	seed := fmt.Sprintf("%s/%04x:%02x:%02x.%x", nodeName, domain, bus, slot, function)
+	return util.GenerateUUIDFromSeed(seed), nil
+}
+
+// parsePCIAddress splits a PCI address of the form DDDD:BB:SS.F into its parts.
+// The domain may be omitted, in which case it defaults to 0.
+func parsePCIAddress(pciAddress string) (domain, bus, slot, function uint64, err error) {
+	parts := strings.Split(strings.ToLower(pciAddress), ":")
+	switch len(parts) {
+	case 2:
+		parts = append([]string{"0000"}, parts...)
+	case 3:
+	default:
+		return 0, 0, 0, 0, fmt.Errorf("malformed PCI address: %s", pciAddress)
+	}
+
+	slotFunction := strings.Split(parts[2], ".")
+	if len(slotFunction) != 2 {
+		return 0, 0, 0, 0, fmt.Errorf("malformed PCI address: %s", pciAddress)
+	}
+
+	if domain, err = strconv.ParseUint(parts[0], 16, 32); err != nil {
+		return 0, 0, 0, 0, fmt.Errorf("malformed PCI domain in %s: %v", pciAddress, err)
+	}
+	if bus, err = strconv.ParseUint(parts[1], 16, 8); err != nil {
+		return 0, 0, 0, 0, fmt.Errorf("malformed PCI bus in %s: %v", pciAddress, err)
+	}
+	if slot, err = strconv.ParseUint(slotFunction[0], 16, 8); err != nil || slot > 0x1f {
+		return 0, 0, 0, 0, fmt.Errorf("malformed PCI slot in %s", pciAddress)
+	}
+	if function, err = strconv.ParseUint(slotFunction[1], 16, 8); err != nil || function > 0x7 {
+		return 0, 0, 0, 0, fmt.Errorf("malformed PCI function in %s", pciAddress)
+	}
+	return domain, bus, slot, function, nil
+}
+
+// DiscoverPermittedHostPCIDevices returns the devices in sysfs matched by
+// selectors. Devices must be bound to vfio-pci, unless they may be rebound by
+// the plugin, in which case any driver is accepted and the device is rebound
+// when it is prepared. Excluded devices are returned as unavailable.
+func DiscoverPermittedHostPCIDevices(sysfsRoot string, nodeName string, selectors *deviceSelectors) ([]*PCIDevice, error) {
 	initHandler()
 
-	iommuToPCIMap := make(map[string]string)
+	pciBasePath := filepath.Join(sysfsRoot, pciDevicesPath)
 
-	pciDevicesMap := make(map[string][]*PCIDevice)
+	var pciDevices []*PCIDevice
 	err := filepath.Walk(pciBasePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
 		if info.IsDir() {
 			return nil
 		}
@@ -55,34 +132,89 @@ func DiscoverPermittedHostPCIDevices(supportedPCIDeviceMap map[string]string) (m
 			log.Printf("Failed to get vendor:device ID for device: %s, error: %v", info.Name(), err)
 			return nil
 		}
+		classCode, err := Handler.GetDeviceClass(pciBasePath, info.Name())
+		if err != nil {
+			log.Printf("Failed to get class code for device: %s, error: %v", info.Name(), err)
+		}
+		subsystemID, err := Handler.GetDeviceSubsystemID(pciBasePath, info.Name())
+		if err != nil {
+			log.Printf("Failed to get subsystem ID for device: %s, error: %v", info.Name(), err)
+		}
+		serialNumber, serialNumberErr := Handler.GetDeviceSerialNumber(pciBasePath, info.Name())
+		if serialNumberErr != nil {
+			log.Printf("Failed to get serial number for device: %s, error: %v", info.Name(), serialNumberErr)
+		}
 
-		if _, supported := supportedPCIDeviceMap[pciID]; supported {
+		match := selectors.match(info.Name(), pciID, classCode, subsystemID, serialNumber)
+		if match != nil && match.excluded == "" && serialNumberErr != nil && selectors.excludesSerialNumbers(info.Name(), pciID, classCode, subsystemID) {
+			// The device may be one whose serial number is excluded, so it
+			// must not be handed out.
+			match.autoBind = false
+			match.excluded = fmt.Sprintf("unable to check the serial number exclusions: %v", serialNumberErr)
+		}
+		if match != nil {
+			// Excluded devices are advertised whatever driver they are bound
+			// to, so that it is visible why they are not handed out.
 			driver, err := Handler.GetDeviceDriver(pciBasePath, info.Name())
-			if err != nil || driver != "vfio-pci" {
+			if match.excluded == "" && (err != nil || (driver != vfioPCIDriver && !match.autoBind)) {
 				log.Printf("Driver error: %v", err)
 				return nil
 			}
 
+			deviceUUID, err := GenerateDeviceUUID(nodeName, info.Name())
+			if err != nil {
+				log.Printf("UUID generation error: %v", err)
+				return nil
+			}
+
 			pcidev := &PCIDevice{
-				uuid:           uuid.New().String(),
-				pciID:          pciID,
-				pciAddress:     info.Name(),
-				vendorSelector: pciID,
-				resourceName:   supportedPCIDeviceMap[pciID],
+				uuid:         deviceUUID,
+				pciID:        pciID,
+				classCode:    classCode,
+				subsystemID:  subsystemID,
+				serialNumber: serialNumber,
+				pciAddress:   info.Name(),
+				resourceName: match.resourceName,
+				autoBind:     match.autoBind,
 			}
 
 			iommuGroup, err := Handler.GetDeviceIOMMUGroup(pciBasePath, info.Name())
-			if err != nil {
+			if err != nil && match.excluded == "" {
 				log.Printf("IOMMU group error: %v", err)
 				return nil
 			}
 			pcidev.iommuGroup = iommuGroup
 			pcidev.driver = driver
 			pcidev.numaNode = Handler.GetDeviceNumaNode(pciBasePath, info.Name())
+			pcidev.linkSpeed, pcidev.linkWidth = Handler.GetDeviceLink(pciBasePath, info.Name())
 
-			iommuToPCIMap[pcidev.iommuGroup] = pcidev.pciAddress
+			pcidev.rootComplex, pcidev.upstreamBridges, err = getDeviceTopology(sysfsRoot, info.Name())
+			if err != nil {
+				log.Printf("PCIe topology error: %v", err)
+			}
+
+			if match.excluded != "" {
+				log.Printf("Device %s is excluded: %s", info.Name(), match.excluded)
+				pcidev.unavailableReason = nascrd.DeviceExcludedReason
+				pcidev.unavailableMessage = match.excluded
+				pciDevices = append(pciDevices, pcidev)
+				return nil
+			}
+
+			blocker, err := checkIOMMUGroupViability(sysfsRoot, info.Name(), iommuGroup, selectors)
+			if err != nil {
+				// Without knowing the group the device can not safely be
+				// passed through, advertise it with the reason instead.
+				log.Printf("IOMMU group viability error: %v", err)
+				blocker = err.Error()
+			}
+			if blocker != "" {
+				log.Printf("Device %s can not be passed through: %s", info.Name(), blocker)
+				pcidev.unavailableReason = nascrd.DeviceIOMMUGroupNotViableReason
+				pcidev.unavailableMessage = blocker
+			}
 
-			pciDevicesMap[pciID] = append(pciDevicesMap[pciID], pcidev)
+			pciDevices = append(pciDevices, pcidev)
 		}
 		return nil
 	})
@@ -90,43 +222,92 @@ func DiscoverPermittedHostPCIDevices(supportedPCIDeviceMap map[string]string) (m
 		log.Printf("Failed to discover host devices, error: %v", err)
 	}
 
-	return pciDevicesMap, err
+	return pciDevices, err
 }
 
-// MockDiscoverPermittedHostPCIDevices returns predefined data for testing
-func MockDiscoverPermittedHostPCIDevices(supportedPCIDeviceMap map[string]string) (map[string][]*PCIDevice, error) {
+// getDeviceTopology resolves the root complex of a device and the chain of
+// bridges above it from the location of the device below /sys/devices, e.g.
+// pci0000:00 and [0000:00:01.0] for
+// /sys/devices/pci0000:00/0000:00:01.0/0000:01:00.0.
+func getDeviceTopology(sysfsRoot string, pciAddress string) (string, []string, error) {
+	devicePath, err := filepath.EvalSymlinks(filepath.Join(sysfsRoot, pciDevicesPath, pciAddress))
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to resolve device %s: %v", pciAddress, err)
+	}
+	devicesRoot, err := filepath.EvalSymlinks(filepath.Join(sysfsRoot, "devices"))
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to resolve devices root: %v", err)
+	}
+	relative, err := filepath.Rel(devicesRoot, devicePath)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to locate device %s: %v", pciAddress, err)
+	}
+
+	parts := strings.Split(relative, string(filepath.Separator))
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "pci") {
+		return "", nil, fmt.Errorf("device %s is not attached to a PCI root complex: %s", pciAddress, relative)
+	}
+
+	var bridges []string
+	for _, part := range parts[1 : len(parts)-1] {
+		if _, _, _, _, err := parsePCIAddress(part); err == nil {
+			bridges = append(bridges, part)
+		}
+	}
+	return parts[0], bridges, nil
+}
+
+// MockDiscoverPermittedHostPCIDevices returns the devices of a fake device
+// inventory instead of scanning sysfs.
+func MockDiscoverPermittedHostPCIDevices(inventory *FakeDeviceInventory, nodeName string, selectors *deviceSelectors) ([]*PCIDevice, error) {
 	log.Printf("enter  MockDiscoverPermittedHostPCIDevices")
-	pciDevicesMap := make(map[string][]*PCIDevice)
-	iommuToPCIMap := make(map[string]string)
-
-	for vendorSelector, resourceName := range supportedPCIDeviceMap {
-		pcidev1 := &PCIDevice{
-			uuid:           uuid.New().String(),
-			vendorSelector: vendorSelector,
-			resourceName:   resourceName,
-			pciAddress:     "0000:00:1d." + vendorSelector,
-			driver:         "vfio-pci",
-			iommuGroup:     "20" + vendorSelector,
-			numaNode:       0,
-			pciID:          vendorSelector,
+	var pciDevices []*PCIDevice
+
+	for _, device := range inventory.Devices {
+		match := selectors.match(device.PciAddress, device.PciID, device.Class, device.SubsystemID, device.SerialNumber)
+		if match == nil {
+			continue
+		}
+		if match.excluded == "" && device.Driver != vfioPCIDriver && !match.autoBind {
+			log.Printf("Skipping fake device %s bound to driver %s", device.PciAddress, device.Driver)
+			continue
+		}
+
+		deviceUUID, err := GenerateDeviceUUID(nodeName, device.PciAddress)
+		if err != nil {
+			return nil, err
 		}
 
-		pcidev2 := &PCIDevice{
-			uuid:           uuid.New().String(),
-			vendorSelector: vendorSelector,
-			resourceName:   resourceName,
-			pciAddress:     "0000:00:1e." + vendorSelector,
-			driver:         "vfio-pci",
-			iommuGroup:     "30" + vendorSelector,
-			numaNode:       0,
-			pciID:          vendorSelector,
+		pcidev := &PCIDevice{
+			uuid:            deviceUUID,
+			resourceName:    match.resourceName,
+			pciAddress:      device.PciAddress,
+			driver:          device.Driver,
+			iommuGroup:      device.IOMMUGroup,
+			numaNode:        discoveredNumaNode(device.NumaNode),
+			pciID:           device.PciID,
+			classCode:       device.Class,
+			subsystemID:     device.SubsystemID,
+			serialNumber:    device.SerialNumber,
+			linkSpeed:       device.LinkSpeed,
+			linkWidth:       device.LinkWidth,
+			autoBind:        match.autoBind,
+			rootComplex:     fakeRootComplex(device),
+			upstreamBridges: device.UpstreamBridges,
 		}
-		iommuToPCIMap["20"+vendorSelector] = "0000:00:1d." + vendorSelector
-		iommuToPCIMap["30"+vendorSelector] = "0000:00:1e." + vendorSelector
 
-		pciDevicesMap[vendorSelector] = append(pciDevicesMap[vendorSelector], pcidev1, pcidev2)
+		if match.excluded != "" {
+			log.Printf("Fake device %s is excluded: %s", device.PciAddress, match.excluded)
+			pcidev.unavailableReason = nascrd.DeviceExcludedReason
+			pcidev.unavailableMessage = match.excluded
+		} else if blocker := checkFakeIOMMUGroupViability(inventory, device, selectors); blocker != "" {
+			log.Printf("Fake device %s can not be passed through: %s", device.PciAddress, blocker)
+			pcidev.unavailableReason = nascrd.DeviceIOMMUGroupNotViableReason
+			pcidev.unavailableMessage = blocker
+		}
 
+		pciDevices = append(pciDevices, pcidev)
 	}
 
-	return pciDevicesMap, nil
+	return pciDevices, nil
 }
@@ -0,0 +1,772 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	nascrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/nas/v1alpha1"
+	"kubevirt.io/dra-pci-driver/pkg/fakesysfs"
+)
+
+func TestGenerateDeviceUUIDIsStable(t *testing.T) {
+	want, err := GenerateDeviceUUID("node01", "0000:3b:00.1")
+	if err != nil {
+		t.Fatalf("GenerateDeviceUUID: %v", err)
+	}
+
+	for _, address := range []string{
+		"0000:3b:00.1",
+		"0000:3B:00.1",
+		"3b:00.1",
+		"3B:0.1",
+		"000:3b:00.1",
+	} {
+		got, err := GenerateDeviceUUID("node01", address)
+		if err != nil {
+			t.Errorf("GenerateDeviceUUID(%q): %v", address, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("GenerateDeviceUUID(%q) = %s, want %s", address, got, want)
+		}
+	}
+}
+
+func TestGenerateDeviceUUIDDiffers(t *testing.T) {
+	base, err := GenerateDeviceUUID("node01", "0000:3b:00.1")
+	if err != nil {
+		t.Fatalf("GenerateDeviceUUID: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		nodeName   string
+		pciAddress string
+	}{
+		{"other node", "node02", "0000:3b:00.1"},
+		{"other domain", "node01", "0001:3b:00.1"},
+		{"other bus", "node01", "0000:3c:00.1"},
+		{"other slot", "node01", "0000:3b:01.1"},
+		{"other function", "node01", "0000:3b:00.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GenerateDeviceUUID(tt.nodeName, tt.pciAddress)
+			if err != nil {
+				t.Fatalf("GenerateDeviceUUID: %v", err)
+			}
+			if got == base {
+				t.Errorf("GenerateDeviceUUID(%q, %q) = %s, same as for node01 0000:3b:00.1", tt.nodeName, tt.pciAddress, got)
+			}
+		})
+	}
+}
+
+func TestParsePCIAddress(t *testing.T) {
+	tests := []struct {
+		pciAddress string
+		want       [4]uint64
+		wantErr    bool
+	}{
+		{pciAddress: "0000:00:1f.2", want: [4]uint64{0, 0, 0x1f, 2}},
+		{pciAddress: "10000:af:1f.7", want: [4]uint64{0x10000, 0xaf, 0x1f, 7}},
+		{pciAddress: "AF:00.0", want: [4]uint64{0, 0xaf, 0, 0}},
+		{pciAddress: "0000:00:20.0", wantErr: true},
+		{pciAddress: "0000:00:00.8", wantErr: true},
+		{pciAddress: "0000:100:00.0", wantErr: true},
+		{pciAddress: "0000:00:00", wantErr: true},
+		{pciAddress: "00.0", wantErr: true},
+		{pciAddress: "0:0:0:00.0", wantErr: true},
+		{pciAddress: "zz:00.0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pciAddress, func(t *testing.T) {
+			domain, bus, slot, function, err := parsePCIAddress(tt.pciAddress)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parsePCIAddress(%q) succeeded, want error", tt.pciAddress)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsePCIAddress(%q): %v", tt.pciAddress, err)
+			}
+			if got := [4]uint64{domain, bus, slot, function}; got != tt.want {
+				t.Errorf("parsePCIAddress(%q) = %v, want %v", tt.pciAddress, got, tt.want)
+			}
+		})
+	}
+}
+
+// discoveredDevice is the part of a discovered PCIDevice the discovery tests
+// compare.
+type discoveredDevice struct {
+	resourceName       string
+	driver             string
+	autoBind           bool
+	iommuGroup         string
+	numaNode           int
+	serialNumber       string
+	linkSpeed          string
+	linkWidth          int
+	rootComplex        string
+	upstreamBridges    []string
+	unavailableReason  string
+	unavailableMessage string
+}
+
+// discoveryTest discovers devices on a fake sysfs tree. $SYSFS in the wanted
+// unavailable messages stands for the root of the tree.
+type discoveryTest struct {
+	name         string
+	devices      []fakesysfs.Device
+	setup        func(t *testing.T, root string)
+	selectors    []nascrd.DiscoverySelector
+	exclusions   *deviceExclusions
+	autoBindVFIO bool
+	want         map[string]discoveredDevice
+}
+
+func fakeNVMe(address string, driver string, iommuGroup string) fakesysfs.Device {
+	return fakesysfs.Device{
+		Address:     address,
+		PCIID:       "1b36:0010",
+		Class:       "010802",
+		SubsystemID: "1af4:1100",
+		Driver:      driver,
+		IOMMUGroup:  iommuGroup,
+		NumaNode:    -1,
+	}
+}
+
+func fakeNIC(address string, driver string, iommuGroup string) fakesysfs.Device {
+	return fakesysfs.Device{
+		Address:    address,
+		PCIID:      "8086:100e",
+		Class:      "020000",
+		Driver:     driver,
+		IOMMUGroup: iommuGroup,
+		NumaNode:   -1,
+	}
+}
+
+func discoverySelector(resourceName string, selector nascrd.PCISelector) nascrd.DiscoverySelector {
+	return nascrd.DiscoverySelector{ResourceName: resourceName, PCISelector: selector}
+}
+
+var nvmeSelector = discoverySelector("nvme", nascrd.PCISelector{PCIVendorSelector: "1b36:0010"})
+
+// nvmeOnVFIO is how a fakeNVMe bound to vfio-pci on the root bus is
+// discovered with nvmeSelector.
+func nvmeOnVFIO(iommuGroup string) discoveredDevice {
+	return discoveredDevice{
+		resourceName: "nvme",
+		driver:       vfioPCIDriver,
+		iommuGroup:   iommuGroup,
+		numaNode:     -1,
+		rootComplex:  "pci0000:00",
+	}
+}
+
+func runDiscoveryTests(t *testing.T, tests []discoveryTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, err := fakesysfs.New(t.TempDir())
+			if err != nil {
+				t.Fatalf("fakesysfs.New: %v", err)
+			}
+			for _, device := range tt.devices {
+				err := fs.AddDevice(device)
+				if err != nil {
+					t.Fatalf("AddDevice: %v", err)
+				}
+			}
+			if tt.setup != nil {
+				tt.setup(t, fs.Root())
+			}
+
+			selectors := &deviceSelectors{
+				selectors:    tt.selectors,
+				exclusions:   tt.exclusions,
+				autoBindVFIO: tt.autoBindVFIO,
+			}
+			devices, err := DiscoverPermittedHostPCIDevices(fs.Root(), "node01", selectors)
+			if err != nil {
+				t.Fatalf("DiscoverPermittedHostPCIDevices: %v", err)
+			}
+
+			got := make(map[string]discoveredDevice)
+			for _, device := range devices {
+				uuid, err := GenerateDeviceUUID("node01", device.pciAddress)
+				if err != nil {
+					t.Fatalf("GenerateDeviceUUID: %v", err)
+				}
+				if device.uuid != uuid {
+					t.Errorf("device %s has UUID %s, want %s", device.pciAddress, device.uuid, uuid)
+				}
+				got[device.pciAddress] = discoveredDevice{
+					resourceName:       device.resourceName,
+					driver:             device.driver,
+					autoBind:           device.autoBind,
+					iommuGroup:         device.iommuGroup,
+					numaNode:           device.numaNode,
+					serialNumber:       device.serialNumber,
+					linkSpeed:          device.linkSpeed,
+					linkWidth:          device.linkWidth,
+					rootComplex:        device.rootComplex,
+					upstreamBridges:    device.upstreamBridges,
+					unavailableReason:  device.unavailableReason,
+					unavailableMessage: strings.ReplaceAll(device.unavailableMessage, fs.Root(), "$SYSFS"),
+				}
+			}
+
+			want := tt.want
+			if want == nil {
+				want = map[string]discoveredDevice{}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("DiscoverPermittedHostPCIDevices() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestDiscoverPermittedHostPCIDevices(t *testing.T) {
+	runDiscoveryTests(t, []discoveryTest{
+		{
+			name:      "vendor selector",
+			devices:   []fakesysfs.Device{fakeNVMe("0000:00:07.0", vfioPCIDriver, "7"), fakeNIC("0000:00:03.0", vfioPCIDriver, "3")},
+			selectors: []nascrd.DiscoverySelector{nvmeSelector},
+			want:      map[string]discoveredDevice{"0000:00:07.0": nvmeOnVFIO("7")},
+		},
+		{
+			name:    "no selectors",
+			devices: []fakesysfs.Device{fakeNVMe("0000:00:07.0", vfioPCIDriver, "7")},
+		},
+		{
+			name:      "host driver",
+			devices:   []fakesysfs.Device{fakeNVMe("0000:00:07.0", "nvme", "7")},
+			selectors: []nascrd.DiscoverySelector{nvmeSelector},
+		},
+		{
+			name:      "without IOMMU group",
+			devices:   []fakesysfs.Device{fakeNVMe("0000:00:07.0", vfioPCIDriver, "")},
+			selectors: []nascrd.DiscoverySelector{nvmeSelector},
+		},
+	})
+}
+
+func TestDiscoverAutoBindDevices(t *testing.T) {
+	autoBindSelector := nascrd.DiscoverySelector{
+		ResourceName: "nvme",
+		PCISelector:  nascrd.PCISelector{PCIVendorSelector: "1b36:0010"},
+		AutoBindVFIO: true,
+	}
+	runDiscoveryTests(t, []discoveryTest{
+		{
+			name:      "auto bind disabled on the plugin",
+			devices:   []fakesysfs.Device{fakeNVMe("0000:00:07.0", "nvme", "7")},
+			selectors: []nascrd.DiscoverySelector{autoBindSelector},
+		},
+		{
+			name:         "auto bind",
+			devices:      []fakesysfs.Device{fakeNVMe("0000:00:07.0", "nvme", "7")},
+			selectors:    []nascrd.DiscoverySelector{autoBindSelector},
+			autoBindVFIO: true,
+			want: map[string]discoveredDevice{
+				"0000:00:07.0": {resourceName: "nvme", driver: "nvme", autoBind: true, iommuGroup: "7", numaNode: -1, rootComplex: "pci0000:00"},
+			},
+		},
+		{
+			name:         "auto bind of a device on vfio-pci",
+			devices:      []fakesysfs.Device{fakeNVMe("0000:00:07.0", vfioPCIDriver, "7")},
+			selectors:    []nascrd.DiscoverySelector{autoBindSelector},
+			autoBindVFIO: true,
+			want: map[string]discoveredDevice{
+				"0000:00:07.0": {resourceName: "nvme", driver: vfioPCIDriver, autoBind: true, iommuGroup: "7", numaNode: -1, rootComplex: "pci0000:00"},
+			},
+		},
+	})
+}
+
+func TestDiscoverIOMMUGroupViability(t *testing.T) {
+	notViable := func(iommuGroup string, message string) discoveredDevice {
+		device := nvmeOnVFIO(iommuGroup)
+		device.unavailableReason = nascrd.DeviceIOMMUGroupNotViableReason
+		device.unavailableMessage = message
+		return device
+	}
+	runDiscoveryTests(t, []discoveryTest{
+		{
+			name:      "member on host driver",
+			devices:   []fakesysfs.Device{fakeNVMe("0000:00:07.0", vfioPCIDriver, "7"), fakeNIC("0000:00:07.1", "e1000", "7")},
+			selectors: []nascrd.DiscoverySelector{nvmeSelector},
+			want: map[string]discoveredDevice{
+				"0000:00:07.0": notViable("7", "IOMMU group 7 member 0000:00:07.1 is bound to e1000"),
+			},
+		},
+		{
+			name:      "member on vfio-pci",
+			devices:   []fakesysfs.Device{fakeNVMe("0000:00:07.0", vfioPCIDriver, "7"), fakeNIC("0000:00:07.1", vfioPCIDriver, "7")},
+			selectors: []nascrd.DiscoverySelector{nvmeSelector},
+			want:      map[string]discoveredDevice{"0000:00:07.0": nvmeOnVFIO("7")},
+		},
+		{
+			name:      "member on pci-stub",
+			devices:   []fakesysfs.Device{fakeNVMe("0000:00:07.0", vfioPCIDriver, "7"), fakeNIC("0000:00:07.1", "pci-stub", "7")},
+			selectors: []nascrd.DiscoverySelector{nvmeSelector},
+			want:      map[string]discoveredDevice{"0000:00:07.0": nvmeOnVFIO("7")},
+		},
+		{
+			name:      "member unbound",
+			devices:   []fakesysfs.Device{fakeNVMe("0000:00:07.0", vfioPCIDriver, "7"), fakeNIC("0000:00:07.1", "", "7")},
+			selectors: []nascrd.DiscoverySelector{nvmeSelector},
+			want:      map[string]discoveredDevice{"0000:00:07.0": nvmeOnVFIO("7")},
+		},
+		{
+			name: "member is a bridge",
+			devices: []fakesysfs.Device{
+				fakeNVMe("0000:00:07.0", vfioPCIDriver, "7"),
+				{Address: "0000:00:07.1", PCIID: "8086:7191", Class: "060400", Driver: "pcieport", IOMMUGroup: "7", NumaNode: -1},
+			},
+			selectors: []nascrd.DiscoverySelector{nvmeSelector},
+			want:      map[string]discoveredDevice{"0000:00:07.0": nvmeOnVFIO("7")},
+		},
+		{
+			name:    "group can not be checked",
+			devices: []fakesysfs.Device{fakeNVMe("0000:00:07.0", vfioPCIDriver, "7")},
+			setup: func(t *testing.T, root string) {
+				err := os.RemoveAll(filepath.Join(root, iommuGroupsPath, "7", "devices"))
+				if err != nil {
+					t.Fatalf("unable to remove IOMMU group members: %v", err)
+				}
+			},
+			selectors: []nascrd.DiscoverySelector{nvmeSelector},
+			want: map[string]discoveredDevice{
+				"0000:00:07.0": notViable("7", "unable to list members of IOMMU group 7: open $SYSFS/kernel/iommu_groups/7/devices: no such file or directory"),
+			},
+		},
+	})
+}
+
+func TestDiscoverIOMMUGroupMembersReboundAlong(t *testing.T) {
+	nicSelector := nascrd.DiscoverySelector{
+		ResourceName: "nic",
+		PCISelector:  nascrd.PCISelector{PCIVendorSelector: "8086:100e"},
+		AutoBindVFIO: true,
+	}
+	runDiscoveryTests(t, []discoveryTest{
+		{
+			name:         "member may be rebound",
+			devices:      []fakesysfs.Device{fakeNVMe("0000:00:07.0", vfioPCIDriver, "7"), fakeNIC("0000:00:07.1", "e1000", "7")},
+			selectors:    []nascrd.DiscoverySelector{nvmeSelector, nicSelector},
+			autoBindVFIO: true,
+			want: map[string]discoveredDevice{
+				"0000:00:07.0": nvmeOnVFIO("7"),
+				"0000:00:07.1": {resourceName: "nic", driver: "e1000", autoBind: true, iommuGroup: "7", numaNode: -1, rootComplex: "pci0000:00"},
+			},
+		},
+		{
+			name:      "member may not be rebound without auto bind on the plugin",
+			devices:   []fakesysfs.Device{fakeNVMe("0000:00:07.0", vfioPCIDriver, "7"), fakeNIC("0000:00:07.1", "e1000", "7")},
+			selectors: []nascrd.DiscoverySelector{nvmeSelector, nicSelector},
+			want: map[string]discoveredDevice{
+				"0000:00:07.0": {
+					resourceName:       "nvme",
+					driver:             vfioPCIDriver,
+					iommuGroup:         "7",
+					numaNode:           -1,
+					rootComplex:        "pci0000:00",
+					unavailableReason:  nascrd.DeviceIOMMUGroupNotViableReason,
+					unavailableMessage: "IOMMU group 7 member 0000:00:07.1 is bound to e1000",
+				},
+			},
+		},
+	})
+}
+
+func TestDiscoverNUMANode(t *testing.T) {
+	onNode := func(numaNode int) fakesysfs.Device {
+		device := fakeNVMe("0000:00:07.0", vfioPCIDriver, "7")
+		device.NumaNode = numaNode
+		return device
+	}
+	withNode := func(numaNode int) discoveredDevice {
+		device := nvmeOnVFIO("7")
+		device.numaNode = numaNode
+		return device
+	}
+	runDiscoveryTests(t, []discoveryTest{
+		{
+			name:      "NUMA node 1",
+			devices:   []fakesysfs.Device{onNode(1)},
+			selectors: []nascrd.DiscoverySelector{nvmeSelector},
+			want:      map[string]discoveredDevice{"0000:00:07.0": withNode(1)},
+		},
+		{
+			name:      "NUMA node 0",
+			devices:   []fakesysfs.Device{onNode(0)},
+			selectors: []nascrd.DiscoverySelector{nvmeSelector},
+			want:      map[string]discoveredDevice{"0000:00:07.0": withNode(0)},
+		},
+		{
+			name:      "unknown NUMA node",
+			devices:   []fakesysfs.Device{onNode(-1)},
+			selectors: []nascrd.DiscoverySelector{nvmeSelector},
+			want:      map[string]discoveredDevice{"0000:00:07.0": withNode(-1)},
+		},
+	})
+}
+
+func TestDiscoverTopology(t *testing.T) {
+	rootPort := fakesysfs.Device{Address: "0000:00:01.0", PCIID: "8086:7191", Class: "060400", Driver: "pcieport", NumaNode: -1}
+	switchPort := fakesysfs.Device{Address: "0000:01:00.0", PCIID: "8086:7191", Class: "060400", Driver: "pcieport", NumaNode: -1, Parent: "0000:00:01.0"}
+	below := func(address string, parent string) fakesysfs.Device {
+		device := fakeNVMe(address, vfioPCIDriver, "12")
+		device.Parent = parent
+		return device
+	}
+	runDiscoveryTests(t, []discoveryTest{
+		{
+			name:      "root bus",
+			devices:   []fakesysfs.Device{fakeNVMe("0000:00:07.0", vfioPCIDriver, "7")},
+			selectors: []nascrd.DiscoverySelector{nvmeSelector},
+			want:      map[string]discoveredDevice{"0000:00:07.0": nvmeOnVFIO("7")},
+		},
+		{
+			name:      "behind a root port",
+			devices:   []fakesysfs.Device{rootPort, below("0000:01:00.0", "0000:00:01.0")},
+			selectors: []nascrd.DiscoverySelector{nvmeSelector},
+			want: map[string]discoveredDevice{
+				"0000:01:00.0": {resourceName: "nvme", driver: vfioPCIDriver, iommuGroup: "12", numaNode: -1, rootComplex: "pci0000:00", upstreamBridges: []string{"0000:00:01.0"}},
+			},
+		},
+		{
+			name:      "behind a switch",
+			devices:   []fakesysfs.Device{rootPort, switchPort, below("0000:02:00.0", "0000:01:00.0")},
+			selectors: []nascrd.DiscoverySelector{nvmeSelector},
+			want: map[string]discoveredDevice{
+				"0000:02:00.0": {resourceName: "nvme", driver: vfioPCIDriver, iommuGroup: "12", numaNode: -1, rootComplex: "pci0000:00", upstreamBridges: []string{"0000:00:01.0", "0000:01:00.0"}},
+			},
+		},
+		{
+			name:      "other root complex",
+			devices:   []fakesysfs.Device{fakeNVMe("0000:80:07.0", vfioPCIDriver, "40")},
+			selectors: []nascrd.DiscoverySelector{nvmeSelector},
+			want: map[string]discoveredDevice{
+				"0000:80:07.0": {resourceName: "nvme", driver: vfioPCIDriver, iommuGroup: "40", numaNode: -1, rootComplex: "pci0000:80"},
+			},
+		},
+	})
+}
+
+func TestDiscoverDeviceSelectors(t *testing.T) {
+	devices := []fakesysfs.Device{
+		fakeNVMe("0000:00:07.0", vfioPCIDriver, "7"),
+		fakeNVMe("0000:00:08.0", vfioPCIDriver, "8"),
+		fakeNIC("0000:00:03.0", vfioPCIDriver, "3"),
+	}
+	nic := discoveredDevice{resourceName: "nic", driver: vfioPCIDriver, iommuGroup: "3", numaNode: -1, rootComplex: "pci0000:00"}
+	runDiscoveryTests(t, []discoveryTest{
+		{
+			name:    "vendor wildcard",
+			devices: devices,
+			selectors: []nascrd.DiscoverySelector{
+				discoverySelector("nvme", nascrd.PCISelector{PCIVendorSelector: "1b36:*"}),
+			},
+			want: map[string]discoveredDevice{"0000:00:07.0": nvmeOnVFIO("7"), "0000:00:08.0": nvmeOnVFIO("8")},
+		},
+		{
+			name:    "class",
+			devices: devices,
+			selectors: []nascrd.DiscoverySelector{
+				discoverySelector("nic", nascrd.PCISelector{PCIClassSelector: "02"}),
+			},
+			want: map[string]discoveredDevice{"0000:00:03.0": nic},
+		},
+		{
+			name:    "class and subsystem",
+			devices: devices,
+			selectors: []nascrd.DiscoverySelector{
+				discoverySelector("nvme", nascrd.PCISelector{PCIClassSelector: "0108", PCISubsystemSelector: "1af4:*"}),
+			},
+			want: map[string]discoveredDevice{"0000:00:07.0": nvmeOnVFIO("7"), "0000:00:08.0": nvmeOnVFIO("8")},
+		},
+		{
+			name:    "subsystem mismatch",
+			devices: devices,
+			selectors: []nascrd.DiscoverySelector{
+				discoverySelector("nvme", nascrd.PCISelector{PCIClassSelector: "0108", PCISubsystemSelector: "1af4:1000"}),
+			},
+		},
+		{
+			name:    "addresses",
+			devices: devices,
+			selectors: []nascrd.DiscoverySelector{
+				discoverySelector("nvme", nascrd.PCISelector{PCIVendorSelector: "*", PCIAddresses: []string{"0000:00:07.0"}}),
+			},
+			want: map[string]discoveredDevice{"0000:00:07.0": nvmeOnVFIO("7")},
+		},
+		{
+			name:    "first resource name wins",
+			devices: devices,
+			selectors: []nascrd.DiscoverySelector{
+				nvmeSelector,
+				discoverySelector("storage", nascrd.PCISelector{PCIClassSelector: "01"}),
+			},
+			want: map[string]discoveredDevice{"0000:00:07.0": nvmeOnVFIO("7"), "0000:00:08.0": nvmeOnVFIO("8")},
+		},
+	})
+}
+
+func TestDiscoverExcludedDevices(t *testing.T) {
+	const serialNumber = "00-1b-21-ff-ff-8a-3c-10"
+	withSerial := fakeNVMe("0000:00:07.0", "nvme", "7")
+	withSerial.SerialNumber = serialNumber
+	excluded := func(driver string, serialNumber string, message string) discoveredDevice {
+		return discoveredDevice{
+			resourceName:       "nvme",
+			driver:             driver,
+			iommuGroup:         "7",
+			numaNode:           -1,
+			serialNumber:       serialNumber,
+			rootComplex:        "pci0000:00",
+			unavailableReason:  nascrd.DeviceExcludedReason,
+			unavailableMessage: message,
+		}
+	}
+	runDiscoveryTests(t, []discoveryTest{
+		{
+			name:    "address excluded by selector",
+			devices: []fakesysfs.Device{fakeNVMe("0000:00:07.0", "nvme", "7"), fakeNVMe("0000:00:08.0", vfioPCIDriver, "8")},
+			selectors: []nascrd.DiscoverySelector{
+				discoverySelector("nvme", nascrd.PCISelector{PCIVendorSelector: "1b36:0010", ExcludedPCIAddresses: []string{"0000:00:07.0"}}),
+			},
+			want: map[string]discoveredDevice{
+				"0000:00:07.0": excluded("nvme", "", "excluded by the device class parameters of nvme"),
+				"0000:00:08.0": nvmeOnVFIO("8"),
+			},
+		},
+		{
+			name:    "serial number excluded by selector",
+			devices: []fakesysfs.Device{withSerial},
+			selectors: []nascrd.DiscoverySelector{
+				discoverySelector("nvme", nascrd.PCISelector{PCIVendorSelector: "1b36:0010", ExcludedSerialNumbers: []string{serialNumber}}),
+			},
+			want: map[string]discoveredDevice{
+				"0000:00:07.0": excluded("nvme", serialNumber, "excluded by the device class parameters of nvme"),
+			},
+		},
+		{
+			name:    "excluded by one of two selectors",
+			devices: []fakesysfs.Device{fakeNVMe("0000:00:07.0", vfioPCIDriver, "7")},
+			selectors: []nascrd.DiscoverySelector{
+				discoverySelector("nvme", nascrd.PCISelector{PCIVendorSelector: "1b36:0010", ExcludedPCIAddresses: []string{"0000:00:07.0"}}),
+				nvmeSelector,
+			},
+			want: map[string]discoveredDevice{"0000:00:07.0": nvmeOnVFIO("7")},
+		},
+		{
+			name:      "address excluded on the node",
+			devices:   []fakesysfs.Device{fakeNVMe("0000:00:07.0", vfioPCIDriver, "7")},
+			selectors: []nascrd.DiscoverySelector{nvmeSelector},
+			exclusions: &deviceExclusions{
+				addresses: map[string]string{"0000:00:07.0": "excluded by file exclusions.yaml"},
+			},
+			want: map[string]discoveredDevice{
+				"0000:00:07.0": excluded(vfioPCIDriver, "", "excluded by file exclusions.yaml"),
+			},
+		},
+		{
+			name:      "serial number excluded on the node",
+			devices:   []fakesysfs.Device{withSerial},
+			selectors: []nascrd.DiscoverySelector{nvmeSelector},
+			exclusions: &deviceExclusions{
+				serialNumbers: map[string]string{serialNumber: "excluded by node annotation"},
+			},
+			want: map[string]discoveredDevice{
+				"0000:00:07.0": excluded("nvme", serialNumber, "excluded by node annotation"),
+			},
+		},
+	})
+}
+
+func TestDiscoverDeviceAttributes(t *testing.T) {
+	device := func(serialNumber string, linkSpeed string, linkWidth int) fakesysfs.Device {
+		device := fakeNVMe("0000:00:07.0", vfioPCIDriver, "7")
+		device.SerialNumber = serialNumber
+		device.LinkSpeed = linkSpeed
+		device.LinkWidth = linkWidth
+		return device
+	}
+	discovered := func(serialNumber string, linkSpeed string, linkWidth int) discoveredDevice {
+		device := nvmeOnVFIO("7")
+		device.serialNumber = serialNumber
+		device.linkSpeed = linkSpeed
+		device.linkWidth = linkWidth
+		return device
+	}
+	runDiscoveryTests(t, []discoveryTest{
+		{
+			name:      "serial number and link",
+			devices:   []fakesysfs.Device{device("00-1b-21-ff-ff-8a-3c-10", "16.0 GT/s PCIe", 4)},
+			selectors: []nascrd.DiscoverySelector{nvmeSelector},
+			want:      map[string]discoveredDevice{"0000:00:07.0": discovered("00-1b-21-ff-ff-8a-3c-10", "16.0 GT/s", 4)},
+		},
+		{
+			name:      "without serial number and link",
+			devices:   []fakesysfs.Device{device("", "", 0)},
+			selectors: []nascrd.DiscoverySelector{nvmeSelector},
+			want:      map[string]discoveredDevice{"0000:00:07.0": discovered("", "", 0)},
+		},
+		{
+			name:      "unknown link speed",
+			devices:   []fakesysfs.Device{device("", "Unknown", 0)},
+			selectors: []nascrd.DiscoverySelector{nvmeSelector},
+			want:      map[string]discoveredDevice{"0000:00:07.0": discovered("", "", 0)},
+		},
+	})
+}
+
+func TestDiscoverTruncatedConfigSpace(t *testing.T) {
+	const serialNumber = "00-1b-21-ff-ff-8a-3c-10"
+	withSerial := fakeNVMe("0000:00:07.0", vfioPCIDriver, "7")
+	withSerial.SerialNumber = serialNumber
+	// Without CAP_SYS_ADMIN the kernel returns the standard header only.
+	truncateConfig := func(t *testing.T, root string) {
+		for _, address := range []string{"0000:00:07.0", "0000:00:07.1"} {
+			err := os.Truncate(filepath.Join(root, "bus/pci/devices", address, "config"), 64)
+			if err != nil && !os.IsNotExist(err) {
+				t.Fatalf("Truncate: %v", err)
+			}
+		}
+	}
+	excluded := discoveredDevice{
+		resourceName:       "nvme",
+		driver:             vfioPCIDriver,
+		iommuGroup:         "7",
+		numaNode:           -1,
+		rootComplex:        "pci0000:00",
+		unavailableReason:  nascrd.DeviceExcludedReason,
+		unavailableMessage: "unable to check the serial number exclusions: config space of device 0000:00:07.0 is truncated to 64 bytes, reading it needs CAP_SYS_ADMIN",
+	}
+	runDiscoveryTests(t, []discoveryTest{
+		{
+			name:      "without serial number exclusions",
+			devices:   []fakesysfs.Device{withSerial},
+			setup:     truncateConfig,
+			selectors: []nascrd.DiscoverySelector{nvmeSelector},
+			want:      map[string]discoveredDevice{"0000:00:07.0": nvmeOnVFIO("7")},
+		},
+		{
+			name:    "serial number excluded by selector",
+			devices: []fakesysfs.Device{withSerial},
+			setup:   truncateConfig,
+			selectors: []nascrd.DiscoverySelector{
+				discoverySelector("nvme", nascrd.PCISelector{PCIVendorSelector: "1b36:0010", ExcludedSerialNumbers: []string{serialNumber}}),
+			},
+			want: map[string]discoveredDevice{"0000:00:07.0": excluded},
+		},
+		{
+			name:      "serial number excluded on the node",
+			devices:   []fakesysfs.Device{withSerial},
+			setup:     truncateConfig,
+			selectors: []nascrd.DiscoverySelector{nvmeSelector},
+			exclusions: &deviceExclusions{
+				serialNumbers: map[string]string{serialNumber: "excluded by node annotation"},
+			},
+			want: map[string]discoveredDevice{"0000:00:07.0": excluded},
+		},
+		{
+			name:    "group member not rebound",
+			devices: []fakesysfs.Device{fakeNVMe("0000:00:07.0", vfioPCIDriver, "7"), fakeNIC("0000:00:07.1", "e1000", "7")},
+			setup:   truncateConfig,
+			selectors: []nascrd.DiscoverySelector{
+				nvmeSelector,
+				{
+					ResourceName: "nic",
+					PCISelector:  nascrd.PCISelector{PCIVendorSelector: "8086:100e", ExcludedSerialNumbers: []string{serialNumber}},
+					AutoBindVFIO: true,
+				},
+			},
+			autoBindVFIO: true,
+			want: map[string]discoveredDevice{
+				"0000:00:07.0": {
+					resourceName:       "nvme",
+					driver:             vfioPCIDriver,
+					iommuGroup:         "7",
+					numaNode:           -1,
+					rootComplex:        "pci0000:00",
+					unavailableReason:  nascrd.DeviceIOMMUGroupNotViableReason,
+					unavailableMessage: "IOMMU group 7 member 0000:00:07.1 is bound to e1000",
+				},
+				"0000:00:07.1": {
+					resourceName:       "nic",
+					driver:             "e1000",
+					iommuGroup:         "7",
+					numaNode:           -1,
+					rootComplex:        "pci0000:00",
+					unavailableReason:  nascrd.DeviceExcludedReason,
+					unavailableMessage: "unable to check the serial number exclusions: config space of device 0000:00:07.1 is truncated to 64 bytes, reading it needs CAP_SYS_ADMIN",
+				},
+			},
+		},
+	})
+}
+
+func TestPublishDiscoveredDeviceAttributes(t *testing.T) {
+	fs, err := fakesysfs.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("fakesysfs.New: %v", err)
+	}
+	device := fakeNVMe("0000:00:07.0", vfioPCIDriver, "7")
+	device.SerialNumber = "00-1b-21-ff-ff-8a-3c-10"
+	device.LinkSpeed = "16.0 GT/s PCIe"
+	device.LinkWidth = 4
+	err = fs.AddDevice(device)
+	if err != nil {
+		t.Fatalf("AddDevice: %v", err)
+	}
+
+	devices, err := DiscoverPermittedHostPCIDevices(fs.Root(), "node01", &deviceSelectors{selectors: []nascrd.DiscoverySelector{nvmeSelector}})
+	if err != nil {
+		t.Fatalf("DiscoverPermittedHostPCIDevices: %v", err)
+	}
+	state := &DeviceState{allocatable: make(AllocatableDevices)}
+	for _, device := range devices {
+		state.allocatable[device.uuid] = &AllocatableDeviceInfo{PCIDevice: device}
+	}
+	var spec nascrd.NodeAllocationStateSpec
+	err = state.syncAllocatableDevicesToCRDSpec(&spec)
+	if err != nil {
+		t.Fatalf("syncAllocatableDevicesToCRDSpec: %v", err)
+	}
+
+	if len(spec.AllocatableDevices) != 1 {
+		t.Fatalf("published %d devices, want 1", len(spec.AllocatableDevices))
+	}
+	pci := spec.AllocatableDevices[0].Pci
+	if pci.SerialNumber != device.SerialNumber || pci.LinkSpeed != "16.0 GT/s" || pci.LinkWidth != 4 {
+		t.Errorf("published serial number %q and link %q x%d, want %q and 16.0 GT/s x4", pci.SerialNumber, pci.LinkSpeed, pci.LinkWidth, device.SerialNumber)
+	}
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// PCINames resolves vendor and device IDs to the human readable names of the
+// PCI ID database, as shipped in the pci.ids file of pciutils.
+type PCINames struct {
+	vendors map[string]string
+	devices map[string]string
+}
+
+// LoadPCINames parses the pci.ids file at path. Subsystems and the device
+// class section at the end of the file are skipped.
+func LoadPCINames(path string) (*PCINames, error) {
+	// #nosec No risk for path injection. The path is provided by the administrator.
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open PCI ID database: %v", err)
+	}
+	defer file.Close()
+
+	names := &PCINames{
+		vendors: make(map[string]string),
+		devices: make(map[string]string),
+	}
+
+	vendor := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// The class section starts with the first line of the form
+		// "C <class> <name>" and is the last one in the file.
+		if strings.HasPrefix(line, "C ") {
+			break
+		}
+
+		depth := len(line) - len(strings.TrimLeft(line, "\t"))
+		id, name, found := strings.Cut(strings.TrimLeft(line, "\t"), "  ")
+		if !found {
+			continue
+		}
+		switch depth {
+		case 0:
+			vendor = strings.ToLower(id)
+			names.vendors[vendor] = name
+		case 1:
+			names.devices[vendor+":"+strings.ToLower(id)] = name
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read PCI ID database: %v", err)
+	}
+
+	return names, nil
+}
+
+// Lookup returns the vendor and device name of the vendor:device ID pciID.
+// Unknown IDs resolve to empty names.
+func (n *PCINames) Lookup(pciID string) (string, string) {
+	if n == nil {
+		return "", ""
+	}
+	vendor, _, _ := strings.Cut(pciID, ":")
+	return n.vendors[vendor], n.devices[pciID]
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// DeviceResetter scrubs the state of a PCI device before it is handed to the
+// next claim.
+type DeviceResetter interface {
+	// Reset resets the device and verifies that it is responsive afterwards.
+	Reset(pciAddress string) error
+}
+
+func NewDeviceResetter(config *Config) DeviceResetter {
+	switch {
+	case !config.flags.deviceReset:
+		return &noopDeviceResetter{}
+	case config.fakeDevices != nil:
+		return &fakeDeviceResetter{inventory: config.fakeDevices}
+	}
+	return &sysfsDeviceResetter{sysfsRoot: config.flags.sysfsRoot}
+}
+
+// sysfsDeviceResetter resets devices through the reset attribute in sysfs,
+// which issues a function level reset or whichever reset method the kernel
+// selected in reset_method.
+type sysfsDeviceResetter struct {
+	sysfsRoot string
+}
+
+func (r *sysfsDeviceResetter) Reset(pciAddress string) error {
+	devicePath := filepath.Join(r.sysfsRoot, pciDevicesPath, pciAddress)
+
+	// reset_method only exists on kernels 5.15 and newer. An empty list
+	// means that every reset method was disabled for the device.
+	// #nosec No risk for path injection. Reading static path of PCI data
+	methods, err := os.ReadFile(filepath.Join(devicePath, "reset_method"))
+	if err == nil && len(bytes.TrimSpace(methods)) == 0 {
+		return fmt.Errorf("no reset method enabled for device %s", pciAddress)
+	}
+
+	resetPath := filepath.Join(devicePath, "reset")
+	if _, err := os.Stat(resetPath); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("device %s does not support reset", pciAddress)
+		}
+		return fmt.Errorf("unable to stat %s: %v", resetPath, err)
+	}
+
+	err = writeSysfs(resetPath, "1")
+	if err != nil {
+		return err
+	}
+
+	return r.verify(devicePath, pciAddress)
+}
+
+// verify reads the vendor ID from the config space of the device. A device
+// that did not come back from the reset reads as all ones.
+func (r *sysfsDeviceResetter) verify(devicePath string, pciAddress string) error {
+	// #nosec No risk for path injection. Reading static path of PCI data
+	file, err := os.Open(filepath.Join(devicePath, "config"))
+	if err != nil {
+		return fmt.Errorf("unable to open config space of device %s: %v", pciAddress, err)
+	}
+	defer file.Close()
+
+	vendor := make([]byte, 2)
+	_, err = io.ReadFull(file, vendor)
+	if err != nil {
+		return fmt.Errorf("unable to read config space of device %s: %v", pciAddress, err)
+	}
+	if vendor[0] == 0xff && vendor[1] == 0xff {
+		return fmt.Errorf("device %s is not responding after reset", pciAddress)
+	}
+	return nil
+}
+
+// fakeDeviceResetter resets the devices of a fake device inventory.
+type fakeDeviceResetter struct {
+	inventory *FakeDeviceInventory
+}
+
+func (r *fakeDeviceResetter) Reset(pciAddress string) error {
+	for _, device := range r.inventory.Devices {
+		if device.PciAddress != pciAddress {
+			continue
+		}
+		if device.ResetFails {
+			return fmt.Errorf("reset of fake device %s failed", pciAddress)
+		}
+		return nil
+	}
+	return fmt.Errorf("fake device %s does not exist", pciAddress)
+}
+
+// noopDeviceResetter is used when device resets are disabled.
+type noopDeviceResetter struct{}
+
+func (r *noopDeviceResetter) Reset(pciAddress string) error {
+	return nil
+}
@@ -0,0 +1,47 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// resetRetryPeriod is how often the devices with a failed reset are
+	// checked. Each device is only reset again once its backoff expired.
+	resetRetryPeriod = 10 * time.Second
+)
+
+// StartResetRetrier retries the resets of the devices whose last reset failed
+// and makes them available again once a reset succeeds, until ctx is done.
+// The resets run outside of the updates of the NodeAllocationState, so that a
+// conflict on the update does not reset the devices again.
+func StartResetRetrier(ctx context.Context, driver *driver) {
+	logger := klog.LoggerWithName(klog.FromContext(ctx), "reset-retrier")
+	ctx = klog.NewContext(ctx, logger)
+
+	go wait.UntilWithContext(ctx, func(ctx context.Context) {
+		err := driver.RetryFailedResets(ctx)
+		if err != nil {
+			logger.Error(err, "Unable to update allocatable devices after a reset succeeded")
+		}
+	}, resetRetryPeriod)
+}
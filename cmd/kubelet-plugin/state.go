@@ -18,11 +18,22 @@ package main
 
 import (
 	"fmt"
+	"log"
+	"sort"
+	"strings"
 	"sync"
+	"time"
+
+	"k8s.io/client-go/util/flowcontrol"
 
 	nascrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/nas/v1alpha1"
 )
 
+const (
+	resetRetryInitialBackoff = 30 * time.Second
+	resetRetryMaxBackoff     = 30 * time.Minute
+)
+
 type AllocatableDevices map[string]*AllocatableDeviceInfo
 type PreparedClaims map[string]*PreparedDevices
 
@@ -48,8 +59,18 @@ type AllocatableDeviceInfo struct {
 type DeviceState struct {
 	sync.Mutex
 	cdi         *CDIHandler
+	binder      DriverBinder
+	resetter    DeviceResetter
 	allocatable AllocatableDevices
 	prepared    PreparedClaims
+	// resetFailed holds the UUIDs of devices whose last reset failed. They
+	// are kept unavailable until a reset succeeds.
+	resetFailed map[string]struct{}
+	// resetBackoff spaces out the retries of failed resets per device.
+	resetBackoff *flowcontrol.Backoff
+	// rolledBackHostDrivers holds the host drivers of devices that were
+	// rebound to vfio-pci by a preparation that was rolled back, by UUID.
+	rolledBackHostDrivers map[string]string
 }
 
 func NewDeviceState(config *Config, possibleDevices AllocatableDevices) (*DeviceState, error) {
@@ -64,11 +85,19 @@ func NewDeviceState(config *Config, possibleDevices AllocatableDevices) (*Device
 	}
 
 	state := &DeviceState{
-		cdi:         cdi,
-		allocatable: possibleDevices,
-		prepared:    make(PreparedClaims),
+		cdi:          cdi,
+		binder:       NewDriverBinder(config),
+		resetter:     NewDeviceResetter(config),
+		allocatable:  possibleDevices,
+		prepared:     make(PreparedClaims),
+		resetFailed:  make(map[string]struct{}),
+		resetBackoff: flowcontrol.NewBackOff(resetRetryInitialBackoff, resetRetryMaxBackoff),
+
+		rolledBackHostDrivers: make(map[string]string),
 	}
 
+	state.syncResetFailedDevicesFromCRDSpec(&config.nascr.Spec)
+
 	err = state.syncPreparedDevicesFromCRDSpec(&config.nascr.Spec)
 	if err != nil {
 		return nil, fmt.Errorf("unable to sync prepared devices from CRD: %v", err)
@@ -144,6 +173,36 @@ func (s *DeviceState) Unprepare(claimUID string) error {
 	return nil
 }
 
+// Rollback forgets the preparation of a claim that could not be recorded in
+// the NodeAllocationState. The devices were never handed to a VM, so they are
+// neither reset nor rebound to their host driver. Devices rebound to vfio-pci
+// stay there, and their host driver is restored when the next claim using them
+// is unprepared.
+func (s *DeviceState) Rollback(claimUID string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	prepared := s.prepared[claimUID]
+	if prepared == nil {
+		return nil
+	}
+
+	if prepared.Type() == nascrd.PciDeviceType {
+		for _, device := range prepared.Pci.Devices {
+			if device.hostDriver != "" {
+				s.rolledBackHostDrivers[device.uuid] = device.hostDriver
+			}
+		}
+	}
+	delete(s.prepared, claimUID)
+
+	err := s.cdi.DeleteClaimSpecFile(claimUID)
+	if err != nil {
+		return fmt.Errorf("unable to delete CDI spec file for claim: %v", err)
+	}
+	return nil
+}
+
 func (s *DeviceState) GetUpdatedSpec(inspec *nascrd.NodeAllocationStateSpec) (*nascrd.NodeAllocationStateSpec, error) {
 	s.Lock()
 	defer s.Unlock()
@@ -162,23 +221,285 @@ func (s *DeviceState) GetUpdatedSpec(inspec *nascrd.NodeAllocationStateSpec) (*n
 	return outspec, nil
 }
 
+// UpdateAllocatable replaces the set of allocatable devices. Devices that are
+// allocated in spec or prepared on the node are kept even if they are no longer
+// part of devices, but flagged as unavailable; their UUIDs are returned.
+func (s *DeviceState) UpdateAllocatable(devices AllocatableDevices, spec *nascrd.NodeAllocationStateSpec) []string {
+	s.Lock()
+	defer s.Unlock()
+
+	inUse := devicesInUse(spec)
+	for _, prepared := range s.prepared {
+		if prepared.Type() != nascrd.PciDeviceType {
+			continue
+		}
+		for _, device := range prepared.Pci.Devices {
+			inUse[device.uuid] = struct{}{}
+		}
+	}
+
+	var retained []string
+	for uuid := range inUse {
+		if _, exists := devices[uuid]; exists {
+			continue
+		}
+		if device, exists := s.allocatable[uuid]; exists {
+			flagged := *device.PCIDevice
+			flagged.unavailableReason = nascrd.DeviceMissingReason
+			flagged.unavailableMessage = ""
+			devices[uuid] = &AllocatableDeviceInfo{PCIDevice: &flagged}
+			retained = append(retained, uuid)
+		}
+	}
+
+	s.allocatable = devices
+	s.flagFailedResets()
+
+	return retained
+}
+
+// retainMissingDevices adds the devices that are in use according to spec but
+// were not discovered to devices, flagged as unavailable, so that claims on
+// devices that disappeared while the plugin was down can still be unprepared.
+// The UUIDs of the retained devices are returned.
+func retainMissingDevices(devices AllocatableDevices, spec *nascrd.NodeAllocationStateSpec) []string {
+	inUse := devicesInUse(spec)
+	for _, prepared := range spec.PreparedClaims {
+		if prepared.Type() != nascrd.PciDeviceType {
+			continue
+		}
+		for _, device := range prepared.Pci.Devices {
+			inUse[device.UUID] = struct{}{}
+		}
+	}
+
+	var retained []string
+	for _, device := range spec.AllocatableDevices {
+		if device.Type() != nascrd.PciDeviceType {
+			continue
+		}
+		if _, exists := inUse[device.Pci.UUID]; !exists {
+			continue
+		}
+		if _, exists := devices[device.Pci.UUID]; exists {
+			continue
+		}
+		devices[device.Pci.UUID] = &AllocatableDeviceInfo{
+			PCIDevice: &PCIDevice{
+				uuid:              device.Pci.UUID,
+				resourceName:      device.Pci.ResourceName,
+				pciAddress:        device.Pci.PciAddress,
+				pciID:             device.Pci.PciID,
+				classCode:         device.Pci.ClassCode,
+				subsystemID:       device.Pci.SubsystemID,
+				serialNumber:      device.Pci.SerialNumber,
+				vendorName:        device.Pci.VendorName,
+				deviceName:        device.Pci.DeviceName,
+				driver:            device.Pci.Driver,
+				linkSpeed:         device.Pci.LinkSpeed,
+				linkWidth:         device.Pci.LinkWidth,
+				iommuGroup:        device.Pci.IOMMUGroup,
+				numaNode:          discoveredNumaNode(device.Pci.NumaNode),
+				rootComplex:       device.Pci.RootComplex,
+				upstreamBridges:   device.Pci.UpstreamBridges,
+				unavailableReason: nascrd.DeviceMissingReason,
+			},
+		}
+		retained = append(retained, device.Pci.UUID)
+	}
+
+	return retained
+}
+
+// devicesInUse returns the UUIDs of all devices allocated to a claim in spec.
+func devicesInUse(spec *nascrd.NodeAllocationStateSpec) map[string]struct{} {
+	inUse := make(map[string]struct{})
+	for _, allocation := range spec.AllocatedClaims {
+		if allocation.Type() != nascrd.PciDeviceType {
+			continue
+		}
+		for _, device := range allocation.Pci.Devices {
+			inUse[device.UUID] = struct{}{}
+		}
+	}
+	return inUse
+}
+
+// preparedOwner returns the claim the device with deviceUUID is prepared for,
+// or an empty string if it is not prepared. A device passed through with VFIO
+// can only be opened by one VM, so it is never prepared for two claims.
+func (s *DeviceState) preparedOwner(deviceUUID string) string {
+	for claimUID, prepared := range s.prepared {
+		if prepared.Type() != nascrd.PciDeviceType {
+			continue
+		}
+		for _, device := range prepared.Pci.Devices {
+			if device.uuid == deviceUUID {
+				return claimUID
+			}
+		}
+	}
+	return ""
+}
+
 func (s *DeviceState) preparePcis(claimUID string, allocated *nascrd.AllocatedPcis) (*PreparedPcis, error) {
 	prepared := &PreparedPcis{}
 
 	for _, device := range allocated.Devices {
-		pciInfo := s.allocatable[device.UUID].PCIDevice
-
 		if _, exists := s.allocatable[device.UUID]; !exists {
 			return nil, fmt.Errorf("requested PCI does not exist: %v", device.UUID)
 		}
+		if reason := s.allocatable[device.UUID].unavailableReason; reason != "" {
+			if message := s.allocatable[device.UUID].unavailableMessage; message != "" {
+				reason = fmt.Sprintf("%v (%v)", reason, message)
+			}
+			return nil, fmt.Errorf("requested PCI is unavailable: %v: %v", device.UUID, reason)
+		}
+
+		if owner := s.preparedOwner(device.UUID); owner != "" {
+			return nil, fmt.Errorf("requested PCI is already prepared for claim %v: %v", owner, device.UUID)
+		}
 
-		prepared.Devices = append(prepared.Devices, pciInfo)
+		pcidev := *s.allocatable[device.UUID].PCIDevice
+		if hostDriver, exists := s.rolledBackHostDrivers[device.UUID]; exists {
+			pcidev.driver = vfioPCIDriver
+			pcidev.hostDriver = hostDriver
+			delete(s.rolledBackHostDrivers, device.UUID)
+		}
+		if pcidev.driver != vfioPCIDriver {
+			err := s.bindVFIO(&pcidev)
+			if err != nil {
+				if restoreErr := s.restoreHostDrivers(prepared.Devices); restoreErr != nil {
+					err = fmt.Errorf("%v; %v", err, restoreErr)
+				}
+				return nil, err
+			}
+		}
+
+		prepared.Devices = append(prepared.Devices, &pcidev)
 	}
 
 	return prepared, nil
 }
 
 func (s *DeviceState) unpreparePcis(claimUID string, devices *PreparedDevices) error {
+	for _, device := range devices.Pci.Devices {
+		allocatable, exists := s.allocatable[device.uuid]
+		if !exists || allocatable.unavailableReason == nascrd.DeviceMissingReason {
+			continue
+		}
+		err := s.resetter.Reset(device.pciAddress)
+		if err != nil {
+			log.Printf("Reset of PCI %v failed, keeping it unavailable: %v", device.uuid, err)
+			s.resetFailed[device.uuid] = struct{}{}
+			s.resetBackoff.Next(device.uuid, s.resetBackoff.Clock.Now())
+			if allocatable.unavailableReason == "" {
+				allocatable.unavailableReason = nascrd.DeviceResetFailedReason
+			}
+		}
+	}
+
+	return s.restoreHostDrivers(devices.Pci.Devices)
+}
+
+// flagFailedResets flags the allocatable devices whose last reset failed as
+// unavailable.
+func (s *DeviceState) flagFailedResets() {
+	for uuid := range s.resetFailed {
+		device, exists := s.allocatable[uuid]
+		if !exists || device.unavailableReason != "" {
+			continue
+		}
+		device.unavailableReason = nascrd.DeviceResetFailedReason
+	}
+}
+
+// RetryFailedResets resets the allocatable devices whose last reset failed
+// again. Each device is retried with an exponential backoff, so that a device
+// that keeps failing is not reset on every call. It reports whether a device
+// became available again.
+func (s *DeviceState) RetryFailedResets() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	now := s.resetBackoff.Clock.Now()
+	recovered := false
+	for uuid := range s.resetFailed {
+		device, exists := s.allocatable[uuid]
+		if !exists || device.unavailableReason == nascrd.DeviceMissingReason {
+			continue
+		}
+		if s.resetBackoff.IsInBackOffSinceUpdate(uuid, now) {
+			continue
+		}
+		err := s.resetter.Reset(device.pciAddress)
+		if err != nil {
+			s.resetBackoff.Next(uuid, now)
+			log.Printf("Reset of PCI %v failed again, retrying in %v: %v", uuid, s.resetBackoff.Get(uuid), err)
+			continue
+		}
+		log.Printf("Reset of PCI %v succeeded, making it available again", uuid)
+		delete(s.resetFailed, uuid)
+		s.resetBackoff.Reset(uuid)
+		if device.unavailableReason == nascrd.DeviceResetFailedReason {
+			device.unavailableReason = ""
+		}
+		recovered = true
+	}
+	s.resetBackoff.GC()
+	return recovered
+}
+
+// syncResetFailedDevicesFromCRDSpec restores the set of devices whose reset
+// failed before the plugin was restarted.
+func (s *DeviceState) syncResetFailedDevicesFromCRDSpec(spec *nascrd.NodeAllocationStateSpec) {
+	for _, device := range spec.AllocatableDevices {
+		if device.Type() != nascrd.PciDeviceType || device.Pci.UnavailableReason != nascrd.DeviceResetFailedReason {
+			continue
+		}
+		s.resetFailed[device.Pci.UUID] = struct{}{}
+		if allocatable, exists := s.allocatable[device.Pci.UUID]; exists && allocatable.unavailableReason == "" {
+			allocatable.unavailableReason = nascrd.DeviceResetFailedReason
+		}
+	}
+}
+
+// bindVFIO rebinds a device that was discovered on its host driver to
+// vfio-pci and remembers the host driver in device.
+func (s *DeviceState) bindVFIO(device *PCIDevice) error {
+	if !device.autoBind {
+		return fmt.Errorf("requested PCI is not bound to %v: %v", vfioPCIDriver, device.uuid)
+	}
+
+	hostDriver, err := s.binder.BindVFIO(device.pciAddress)
+	if err != nil {
+		return fmt.Errorf("unable to bind PCI %v to %v: %v", device.uuid, vfioPCIDriver, err)
+	}
+
+	device.driver = vfioPCIDriver
+	device.hostDriver = hostDriver
+	return nil
+}
+
+// restoreHostDrivers binds the devices that were rebound to vfio-pci back to
+// their host driver. Devices that disappeared from the node are skipped.
+func (s *DeviceState) restoreHostDrivers(devices []*PCIDevice) error {
+	var errs []string
+	for _, device := range devices {
+		if device.hostDriver == "" {
+			continue
+		}
+		if allocatable, exists := s.allocatable[device.uuid]; exists && allocatable.unavailableReason == nascrd.DeviceMissingReason {
+			continue
+		}
+		err := s.binder.RestoreDriver(device.pciAddress, device.hostDriver)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("unable to restore driver %v of PCI %v: %v", device.hostDriver, device.uuid, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", strings.Join(errs, "; "))
+	}
 	return nil
 }
 
@@ -187,9 +508,24 @@ func (s *DeviceState) syncAllocatableDevicesToCRDSpec(spec *nascrd.NodeAllocatio
 	for _, device := range s.allocatable {
 		pcis[device.uuid] = nascrd.AllocatableDevice{
 			Pci: &nascrd.AllocatablePci{
-				UUID:         device.uuid,
-				PciAddress:   device.pciAddress,
-				ResourceName: device.resourceName,
+				UUID:               device.uuid,
+				PciAddress:         device.pciAddress,
+				ResourceName:       device.resourceName,
+				PciID:              device.pciID,
+				ClassCode:          device.classCode,
+				SubsystemID:        device.subsystemID,
+				SerialNumber:       device.serialNumber,
+				VendorName:         device.vendorName,
+				DeviceName:         device.deviceName,
+				Driver:             device.driver,
+				LinkSpeed:          device.linkSpeed,
+				LinkWidth:          device.linkWidth,
+				IOMMUGroup:         device.iommuGroup,
+				NumaNode:           publishedNumaNode(device.numaNode),
+				RootComplex:        device.rootComplex,
+				UpstreamBridges:    device.upstreamBridges,
+				UnavailableReason:  device.unavailableReason,
+				UnavailableMessage: device.unavailableMessage,
 			},
 		}
 	}
@@ -198,6 +534,9 @@ func (s *DeviceState) syncAllocatableDevicesToCRDSpec(spec *nascrd.NodeAllocatio
 	for _, device := range pcis {
 		allocatable = append(allocatable, device)
 	}
+	sort.Slice(allocatable, func(i, j int) bool {
+		return allocatable[i].Pci.UUID < allocatable[j].Pci.UUID
+	})
 
 	spec.AllocatableDevices = allocatable
 
@@ -213,7 +552,12 @@ func (s *DeviceState) syncPreparedDevicesFromCRDSpec(spec *nascrd.NodeAllocation
 		case nascrd.PciDeviceType:
 			prepared[claim] = &PreparedDevices{Pci: &PreparedPcis{}}
 			for _, d := range devices.Pci.Devices {
-				prepared[claim].Pci.Devices = append(prepared[claim].Pci.Devices, pcis[d.UUID].PCIDevice)
+				if _, exists := pcis[d.UUID]; !exists {
+					return fmt.Errorf("prepared PCI for claim '%v' does not exist: %v", claim, d.UUID)
+				}
+				pcidev := *pcis[d.UUID].PCIDevice
+				pcidev.hostDriver = d.HostDriver
+				prepared[claim].Pci.Devices = append(prepared[claim].Pci.Devices, &pcidev)
 			}
 		default:
 			return fmt.Errorf("unknown device type: %v", devices.Type())
@@ -234,7 +578,8 @@ func (s *DeviceState) syncPreparedDevicesToCRDSpec(spec *nascrd.NodeAllocationSt
 			prepared.Pci = &nascrd.PreparedPcis{}
 			for _, device := range devices.Pci.Devices {
 				outdevice := nascrd.PreparedPci{
-					UUID: device.uuid,
+					UUID:       device.uuid,
+					HostDriver: device.hostDriver,
 				}
 				prepared.Pci.Devices = append(prepared.Pci.Devices, outdevice)
 			}
@@ -248,3 +593,20 @@ func (s *DeviceState) syncPreparedDevicesToCRDSpec(spec *nascrd.NodeAllocationSt
 
 	return nil
 }
+
+// publishedNumaNode converts the NUMA node read from sysfs, -1 if unknown, to
+// its NodeAllocationState representation.
+func publishedNumaNode(numaNode int) *int {
+	if numaNode < 0 {
+		return nil
+	}
+	return &numaNode
+}
+
+// discoveredNumaNode is the inverse of publishedNumaNode.
+func discoveredNumaNode(numaNode *int) int {
+	if numaNode == nil {
+		return -1
+	}
+	return *numaNode
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"syscall"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// ueventKernelGroup is the netlink multicast group of kernel uevents.
+	ueventKernelGroup = 1
+	ueventBufferSize  = 64 * 1024
+)
+
+// watchPCIUevents calls notify for every kernel uevent of the PCI subsystem,
+// e.g. when a device is added, removed, bound or unbound, until ctx is done.
+// Kernel uevents of PCI devices are only delivered to the host network
+// namespace.
+func watchPCIUevents(ctx context.Context, notify func()) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return fmt.Errorf("unable to create uevent socket: %v", err)
+	}
+
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: ueventKernelGroup,
+	})
+	if err != nil {
+		syscall.Close(fd)
+		return fmt.Errorf("unable to bind uevent socket: %v", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		syscall.Close(fd)
+	}()
+
+	go func() {
+		logger := klog.FromContext(ctx)
+		buf := make([]byte, ueventBufferSize)
+		for {
+			n, _, err := syscall.Recvfrom(fd, buf, 0)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				if err == syscall.EINTR || err == syscall.ENOBUFS {
+					// Events were lost, rescan to be safe.
+					notify()
+					continue
+				}
+				logger.Error(err, "Unable to receive uevents")
+				return
+			}
+			if isPCIUevent(buf[:n]) {
+				notify()
+			}
+		}
+	}()
+
+	return nil
+}
+
+// isPCIUevent reports whether msg, a NUL separated ACTION@DEVPATH header
+// followed by KEY=VALUE pairs, is a uevent of the PCI subsystem.
+func isPCIUevent(msg []byte) bool {
+	for _, field := range bytes.Split(msg, []byte{0}) {
+		if bytes.Equal(field, []byte("SUBSYSTEM=pci")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// DriverBinder moves PCI devices between their host driver and vfio-pci.
+type DriverBinder interface {
+	// BindVFIO binds the device to vfio-pci and returns the driver it was
+	// bound to before, or an empty string if it already was bound to vfio-pci.
+	BindVFIO(pciAddress string) (string, error)
+	// RestoreDriver binds the device back to hostDriver. It succeeds if the
+	// device already is bound to hostDriver.
+	RestoreDriver(pciAddress string, hostDriver string) error
+}
+
+func NewDriverBinder(config *Config) DriverBinder {
+	if config.fakeDevices != nil {
+		return &fakeDriverBinder{inventory: config.fakeDevices}
+	}
+	return &sysfsDriverBinder{sysfsRoot: config.flags.sysfsRoot}
+}
+
+// sysfsDriverBinder rebinds devices through driver_override and the unbind and
+// bind files of the PCI drivers in sysfs.
+type sysfsDriverBinder struct {
+	sysfsRoot string
+}
+
+func (b *sysfsDriverBinder) BindVFIO(pciAddress string) (string, error) {
+	initHandler()
+
+	devicesPath := filepath.Join(b.sysfsRoot, pciDevicesPath)
+	hostDriver, err := Handler.GetDeviceDriver(devicesPath, pciAddress)
+	if err != nil {
+		return "", fmt.Errorf("unable to get driver of %s: %v", pciAddress, err)
+	}
+	if hostDriver == vfioPCIDriver {
+		return "", nil
+	}
+
+	if _, err := os.Stat(b.driverPath(vfioPCIDriver)); err != nil {
+		return "", fmt.Errorf("%s driver is not loaded: %v", vfioPCIDriver, err)
+	}
+
+	log.Printf("Rebinding device %s from %s to %s", pciAddress, hostDriver, vfioPCIDriver)
+	err = writeSysfs(filepath.Join(devicesPath, pciAddress, "driver_override"), vfioPCIDriver)
+	if err != nil {
+		return "", err
+	}
+	err = writeSysfs(filepath.Join(b.driverPath(hostDriver), "unbind"), pciAddress)
+	if err != nil {
+		if clearErr := writeSysfs(filepath.Join(devicesPath, pciAddress, "driver_override"), "\n"); clearErr != nil {
+			log.Printf("Failed to clear driver_override of device %s: %v", pciAddress, clearErr)
+		}
+		return "", err
+	}
+
+	err = b.bind(pciAddress, vfioPCIDriver)
+	if err != nil {
+		if restoreErr := b.RestoreDriver(pciAddress, hostDriver); restoreErr != nil {
+			log.Printf("Failed to restore driver %s of device %s: %v", hostDriver, pciAddress, restoreErr)
+		}
+		return "", err
+	}
+
+	return hostDriver, nil
+}
+
+func (b *sysfsDriverBinder) RestoreDriver(pciAddress string, hostDriver string) error {
+	initHandler()
+
+	devicesPath := filepath.Join(b.sysfsRoot, pciDevicesPath)
+	driver, err := Handler.GetDeviceDriver(devicesPath, pciAddress)
+	if err == nil && driver != hostDriver {
+		log.Printf("Rebinding device %s from %s to %s", pciAddress, driver, hostDriver)
+		err = writeSysfs(filepath.Join(b.driverPath(driver), "unbind"), pciAddress)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = writeSysfs(filepath.Join(devicesPath, pciAddress, "driver_override"), "\n")
+	if err != nil {
+		return err
+	}
+
+	if driver == hostDriver {
+		return nil
+	}
+	return b.bind(pciAddress, hostDriver)
+}
+
+// bind binds the unbound device to driver and verifies that the kernel
+// accepted the binding.
+func (b *sysfsDriverBinder) bind(pciAddress string, driver string) error {
+	err := writeSysfs(filepath.Join(b.driverPath(driver), "bind"), pciAddress)
+	if err != nil {
+		return err
+	}
+
+	bound, err := Handler.GetDeviceDriver(filepath.Join(b.sysfsRoot, pciDevicesPath), pciAddress)
+	if err != nil {
+		return fmt.Errorf("unable to verify driver of %s: %v", pciAddress, err)
+	}
+	if bound != driver {
+		return fmt.Errorf("device %s is bound to %s instead of %s", pciAddress, bound, driver)
+	}
+	return nil
+}
+
+func (b *sysfsDriverBinder) driverPath(driver string) string {
+	return filepath.Join(b.sysfsRoot, pciDriversPath, driver)
+}
+
+// writeSysfs writes value to the existing sysfs attribute at path.
+func writeSysfs(path string, value string) error {
+	// #nosec No risk for path injection. Writing static paths of PCI devices and drivers
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(value)
+	if err != nil {
+		return fmt.Errorf("unable to write %q to %s: %v", value, path, err)
+	}
+	return nil
+}
+
+// fakeDriverBinder rebinds the devices of a fake device inventory.
+type fakeDriverBinder struct {
+	inventory *FakeDeviceInventory
+}
+
+func (b *fakeDriverBinder) BindVFIO(pciAddress string) (string, error) {
+	device, err := b.device(pciAddress)
+	if err != nil {
+		return "", err
+	}
+	if device.Driver == vfioPCIDriver {
+		return "", nil
+	}
+	hostDriver := device.Driver
+	device.Driver = vfioPCIDriver
+	return hostDriver, nil
+}
+
+func (b *fakeDriverBinder) RestoreDriver(pciAddress string, hostDriver string) error {
+	device, err := b.device(pciAddress)
+	if err != nil {
+		return err
+	}
+	device.Driver = hostDriver
+	return nil
+}
+
+func (b *fakeDriverBinder) device(pciAddress string) (*FakeDevice, error) {
+	for i := range b.inventory.Devices {
+		if b.inventory.Devices[i].PciAddress == pciAddress {
+			return &b.inventory.Devices[i], nil
+		}
+	}
+	return nil, fmt.Errorf("fake device %s does not exist", pciAddress)
+}
@@ -18,49 +18,60 @@ package main
 
 import (
 	"sync"
+	"time"
+
+	"k8s.io/utils/clock"
 
 	nascrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/nas/v1alpha1"
 )
 
+// pendingAllocation holds the devices tentatively reserved for a claim on a
+// node while the pod of the claim is being scheduled.
+type pendingAllocation struct {
+	devices nascrd.AllocatedDevices
+	// pod is the namespace/name of the pod the devices were reserved for.
+	pod string
+	// reserved is when the devices were last reserved.
+	reserved time.Time
+}
+
 type PerNodeAllocatedClaims struct {
 	sync.RWMutex
-	allocations map[string]map[string]nascrd.AllocatedDevices
+	allocations map[string]map[string]pendingAllocation
+	// clock stamps and expires the reservations.
+	clock clock.PassiveClock
 }
 
 func NewPerNodeAllocatedClaims() *PerNodeAllocatedClaims {
 	return &PerNodeAllocatedClaims{
-		allocations: make(map[string]map[string]nascrd.AllocatedDevices),
+		allocations: make(map[string]map[string]pendingAllocation),
+		clock:       clock.RealClock{},
 	}
 }
 
 func (p *PerNodeAllocatedClaims) Exists(claimUID, node string) bool {
-	p.RLock()
-	defer p.RUnlock()
-
-	_, exists := p.allocations[claimUID]
-	if !exists {
-		return false
-	}
-
-	_, exists = p.allocations[claimUID][node]
+	_, exists := p.Get(claimUID, node)
 	return exists
 }
 
-func (p *PerNodeAllocatedClaims) Get(claimUID, node string) nascrd.AllocatedDevices {
+// Get returns the devices pending for a claim on node and whether there are
+// any. Looking both up under one lock keeps a concurrent Remove from handing
+// out an empty allocation.
+func (p *PerNodeAllocatedClaims) Get(claimUID, node string) (nascrd.AllocatedDevices, bool) {
 	p.RLock()
 	defer p.RUnlock()
 
-	if !p.Exists(claimUID, node) {
-		return nascrd.AllocatedDevices{}
-	}
-	return p.allocations[claimUID][node]
+	allocation, exists := p.allocations[claimUID][node]
+	return allocation.devices, exists
 }
 
+// VisitNode calls visitor for every claim pending on node. visitor must not
+// modify p, the read lock is held while it runs.
 func (p *PerNodeAllocatedClaims) VisitNode(node string, visitor func(claimUID string, allocation nascrd.AllocatedDevices)) {
 	p.RLock()
 	for claimUID := range p.allocations {
 		if allocation, exists := p.allocations[claimUID][node]; exists {
-			visitor(claimUID, allocation)
+			visitor(claimUID, allocation.devices)
 		}
 	}
 	p.RUnlock()
@@ -70,22 +81,29 @@ func (p *PerNodeAllocatedClaims) Visit(visitor func(claimUID, node string, alloc
 	p.RLock()
 	for claimUID := range p.allocations {
 		for node, allocation := range p.allocations[claimUID] {
-			visitor(claimUID, node, allocation)
+			visitor(claimUID, node, allocation.devices)
 		}
 	}
 	p.RUnlock()
 }
 
-func (p *PerNodeAllocatedClaims) Set(claimUID, node string, devices nascrd.AllocatedDevices) {
+// Set reserves devices for a claim of pod on node, replacing an earlier
+// reservation and restarting its expiry.
+func (p *PerNodeAllocatedClaims) Set(claimUID, node, pod string, devices nascrd.AllocatedDevices) {
 	p.Lock()
 	defer p.Unlock()
 
 	_, exists := p.allocations[claimUID]
 	if !exists {
-		p.allocations[claimUID] = make(map[string]nascrd.AllocatedDevices)
+		p.allocations[claimUID] = make(map[string]pendingAllocation)
 	}
 
-	p.allocations[claimUID][node] = devices
+	p.allocations[claimUID][node] = pendingAllocation{
+		devices:  devices,
+		pod:      pod,
+		reserved: p.clock.Now(),
+	}
+	p.updateMetrics()
 }
 
 func (p *PerNodeAllocatedClaims) RemoveNode(claimUID, node string) {
@@ -98,6 +116,10 @@ func (p *PerNodeAllocatedClaims) RemoveNode(claimUID, node string) {
 	}
 
 	delete(p.allocations[claimUID], node)
+	if len(p.allocations[claimUID]) == 0 {
+		delete(p.allocations, claimUID)
+	}
+	p.updateMetrics()
 }
 
 func (p *PerNodeAllocatedClaims) Remove(claimUID string) {
@@ -105,4 +127,71 @@ func (p *PerNodeAllocatedClaims) Remove(claimUID string) {
 	defer p.Unlock()
 
 	delete(p.allocations, claimUID)
+	p.updateMetrics()
+}
+
+// RemoveExpired drops the reservations made more than ttl ago and returns how
+// many there were.
+func (p *PerNodeAllocatedClaims) RemoveExpired(ttl time.Duration) int {
+	deadline := p.clock.Now().Add(-ttl)
+	return p.removeIf(pendingAllocationExpired, func(node string, allocation pendingAllocation) bool {
+		return allocation.reserved.Before(deadline)
+	})
+}
+
+// RemovePod drops the reservations made for pod on any node but keepNode and
+// returns how many there were. An empty keepNode drops all of them.
+func (p *PerNodeAllocatedClaims) RemovePod(pod, keepNode string) int {
+	reason := pendingAllocationNodeNotSelected
+	if keepNode == "" {
+		reason = pendingAllocationPodGone
+	}
+	return p.removeIf(reason, func(node string, allocation pendingAllocation) bool {
+		return allocation.pod == pod && node != keepNode
+	})
+}
+
+func (p *PerNodeAllocatedClaims) removeIf(reason string, remove func(node string, allocation pendingAllocation) bool) int {
+	p.Lock()
+	defer p.Unlock()
+
+	removed := 0
+	for claimUID, nodes := range p.allocations {
+		for node, allocation := range nodes {
+			if remove(node, allocation) {
+				delete(nodes, node)
+				removed++
+			}
+		}
+		if len(nodes) == 0 {
+			delete(p.allocations, claimUID)
+		}
+	}
+	if removed > 0 {
+		pendingAllocationsDroppedCounter.WithLabelValues(reason).Add(float64(removed))
+		p.updateMetrics()
+	}
+	return removed
+}
+
+// updateMetrics publishes the number of pending claims and devices per node.
+// It must be called with the lock held.
+func (p *PerNodeAllocatedClaims) updateMetrics() {
+	claims := make(map[string]int)
+	devices := make(map[string]int)
+	for _, nodes := range p.allocations {
+		for node, allocation := range nodes {
+			claims[node]++
+			if allocation.devices.Type() == nascrd.PciDeviceType {
+				devices[node] += len(allocation.devices.Pci.Devices)
+			}
+		}
+	}
+
+	pendingAllocationsGauge.Reset()
+	pendingAllocatedDevicesGauge.Reset()
+	for node := range claims {
+		pendingAllocationsGauge.WithLabelValues(node).Set(float64(claims[node]))
+		pendingAllocatedDevicesGauge.WithLabelValues(node).Set(float64(devices[node]))
+	}
 }
@@ -0,0 +1,226 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"testing"
+	"time"
+
+	resourcev1 "k8s.io/api/resource/v1alpha2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog/v2"
+	testingclock "k8s.io/utils/clock/testing"
+
+	nascrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/nas/v1alpha1"
+)
+
+// newTestPendingAllocations returns pending allocations stamped by a fake
+// clock.
+func newTestPendingAllocations() (*PerNodeAllocatedClaims, *testingclock.FakeClock) {
+	clock := testingclock.NewFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	pending := NewPerNodeAllocatedClaims()
+	pending.clock = clock
+	return pending, clock
+}
+
+func pendingDevices(uuids ...string) nascrd.AllocatedDevices {
+	devices := nascrd.AllocatedDevices{Pci: &nascrd.AllocatedPcis{}}
+	for _, uuid := range uuids {
+		devices.Pci.Devices = append(devices.Pci.Devices, nascrd.AllocatedPci{UUID: uuid})
+	}
+	return devices
+}
+
+// metricValue returns the value of the metric name with the label set to
+// value, and whether it exists.
+func metricValue(t *testing.T, name string, label string, value string) (float64, bool) {
+	t.Helper()
+	families, err := legacyregistry.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, pair := range metric.GetLabel() {
+				if pair.GetName() != label || pair.GetValue() != value {
+					continue
+				}
+				if metric.GetCounter() != nil {
+					return metric.GetCounter().GetValue(), true
+				}
+				return metric.GetGauge().GetValue(), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func droppedCount(t *testing.T, reason string) float64 {
+	t.Helper()
+	value, _ := metricValue(t, metricsSubsystem+"_pending_allocations_dropped_total", "reason", reason)
+	return value
+}
+
+func expectPendingGauges(t *testing.T, node string, claims int, devices int) {
+	t.Helper()
+	for name, want := range map[string]int{
+		metricsSubsystem + "_pending_allocations":       claims,
+		metricsSubsystem + "_pending_allocated_devices": devices,
+	} {
+		got, exists := metricValue(t, name, "node", node)
+		if want == 0 {
+			if exists {
+				t.Errorf("%s{node=%q} = %v, want no series", name, node, got)
+			}
+			continue
+		}
+		if !exists || got != float64(want) {
+			t.Errorf("%s{node=%q} = %v (exists %v), want %d", name, node, got, exists, want)
+		}
+	}
+}
+
+func expectPending(t *testing.T, pending *PerNodeAllocatedClaims, want map[string][]string) {
+	t.Helper()
+	got := make(map[string][]string)
+	pending.Visit(func(claimUID, node string, allocation nascrd.AllocatedDevices) {
+		got[claimUID] = append(got[claimUID], node)
+	})
+	if len(got) != len(want) {
+		t.Errorf("pending claims = %v, want %v", got, want)
+	}
+	for claimUID, nodes := range want {
+		for _, node := range nodes {
+			if !pending.Exists(claimUID, node) {
+				t.Errorf("claim %s is not pending on %s, pending claims %v", claimUID, node, got)
+			}
+		}
+		if len(got[claimUID]) != len(nodes) {
+			t.Errorf("claim %s is pending on %v, want %v", claimUID, got[claimUID], nodes)
+		}
+	}
+}
+
+func TestRemoveExpired(t *testing.T) {
+	pending, clock := newTestPendingAllocations()
+	dropped := droppedCount(t, pendingAllocationExpired)
+
+	pending.Set("claim-1", "node-a", "default/pod-1", pendingDevices("dev-1"))
+	pending.Set("claim-2", "node-a", "default/pod-2", pendingDevices("dev-2"))
+	clock.Step(3 * time.Minute)
+	pending.Set("claim-1", "node-b", "default/pod-1", pendingDevices("dev-3", "dev-4"))
+	// Reserving again restarts the expiry.
+	pending.Set("claim-2", "node-a", "default/pod-2", pendingDevices("dev-2"))
+	clock.Step(3 * time.Minute)
+
+	if removed := pending.RemoveExpired(5 * time.Minute); removed != 1 {
+		t.Errorf("RemoveExpired() = %d, want 1", removed)
+	}
+	expectPending(t, pending, map[string][]string{
+		"claim-1": {"node-b"},
+		"claim-2": {"node-a"},
+	})
+	if got := droppedCount(t, pendingAllocationExpired) - dropped; got != 1 {
+		t.Errorf("dropped expired allocations = %v, want 1", got)
+	}
+	expectPendingGauges(t, "node-a", 1, 1)
+	expectPendingGauges(t, "node-b", 1, 2)
+
+	if removed := pending.RemoveExpired(5 * time.Minute); removed != 0 {
+		t.Errorf("RemoveExpired() = %d on unchanged clock, want 0", removed)
+	}
+
+	clock.Step(3 * time.Minute)
+	if removed := pending.RemoveExpired(5 * time.Minute); removed != 2 {
+		t.Errorf("RemoveExpired() = %d, want 2", removed)
+	}
+	expectPending(t, pending, nil)
+	if got := droppedCount(t, pendingAllocationExpired) - dropped; got != 3 {
+		t.Errorf("dropped expired allocations = %v, want 3", got)
+	}
+	expectPendingGauges(t, "node-a", 0, 0)
+	expectPendingGauges(t, "node-b", 0, 0)
+}
+
+func TestRemovePod(t *testing.T) {
+	pending, _ := newTestPendingAllocations()
+	notSelected := droppedCount(t, pendingAllocationNodeNotSelected)
+	gone := droppedCount(t, pendingAllocationPodGone)
+
+	pending.Set("claim-1", "node-a", "default/pod-1", pendingDevices("dev-1"))
+	pending.Set("claim-1", "node-b", "default/pod-1", pendingDevices("dev-2"))
+	pending.Set("claim-2", "node-b", "default/pod-1", pendingDevices("dev-3", "dev-4"))
+	pending.Set("claim-3", "node-a", "default/pod-2", pendingDevices("dev-5"))
+	expectPendingGauges(t, "node-a", 2, 2)
+	expectPendingGauges(t, "node-b", 2, 3)
+
+	if removed := pending.RemovePod("default/pod-1", "node-b"); removed != 1 {
+		t.Errorf("RemovePod() = %d, want 1", removed)
+	}
+	expectPending(t, pending, map[string][]string{
+		"claim-1": {"node-b"},
+		"claim-2": {"node-b"},
+		"claim-3": {"node-a"},
+	})
+	if got := droppedCount(t, pendingAllocationNodeNotSelected) - notSelected; got != 1 {
+		t.Errorf("dropped allocations on unselected nodes = %v, want 1", got)
+	}
+	expectPendingGauges(t, "node-a", 1, 1)
+	expectPendingGauges(t, "node-b", 2, 3)
+
+	if removed := pending.RemovePod("default/pod-1", ""); removed != 2 {
+		t.Errorf("RemovePod() = %d, want 2", removed)
+	}
+	expectPending(t, pending, map[string][]string{
+		"claim-3": {"node-a"},
+	})
+	if got := droppedCount(t, pendingAllocationPodGone) - gone; got != 2 {
+		t.Errorf("dropped allocations of gone pods = %v, want 2", got)
+	}
+	expectPendingGauges(t, "node-a", 1, 1)
+	expectPendingGauges(t, "node-b", 0, 0)
+
+	if removed := pending.RemovePod("default/pod-3", ""); removed != 0 {
+		t.Errorf("RemovePod() = %d for a pod without allocations, want 0", removed)
+	}
+}
+
+func TestDropUnselectedNodes(t *testing.T) {
+	pending, _ := newTestPendingAllocations()
+	pending.Set("claim-1", "node-a", "default/pod-1", pendingDevices("dev-1"))
+	pending.Set("claim-1", "node-b", "default/pod-1", pendingDevices("dev-2"))
+	pending.Set("claim-2", "node-a", "default/pod-2", pendingDevices("dev-3"))
+
+	schedulingCtx := &resourcev1.PodSchedulingContext{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod-1"},
+	}
+	dropUnselectedNodes(klog.Background(), pending, schedulingCtx)
+	expectPending(t, pending, map[string][]string{
+		"claim-1": {"node-a", "node-b"},
+		"claim-2": {"node-a"},
+	})
+
+	schedulingCtx.Spec.SelectedNode = "node-b"
+	dropUnselectedNodes(klog.Background(), pending, schedulingCtx)
+	expectPending(t, pending, map[string][]string{
+		"claim-1": {"node-b"},
+		"claim-2": {"node-a"},
+	})
+}
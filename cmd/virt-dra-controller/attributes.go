@@ -0,0 +1,158 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	nascrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/nas/v1alpha1"
+	pcicrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/v1alpha1"
+)
+
+// deviceAttributes maps the attribute names usable in claim selectors to
+// their value on a device. An empty value means that the device does not have
+// the attribute.
+var deviceAttributes = map[string]func(device *nascrd.AllocatablePci) string{
+	"vendorID": func(device *nascrd.AllocatablePci) string {
+		vendor, _, _ := strings.Cut(device.PciID, ":")
+		return vendor
+	},
+	"deviceID": func(device *nascrd.AllocatablePci) string {
+		_, id, _ := strings.Cut(device.PciID, ":")
+		return id
+	},
+	"pciID":        func(device *nascrd.AllocatablePci) string { return device.PciID },
+	"pciAddress":   func(device *nascrd.AllocatablePci) string { return device.PciAddress },
+	"classCode":    func(device *nascrd.AllocatablePci) string { return device.ClassCode },
+	"subsystemID":  func(device *nascrd.AllocatablePci) string { return device.SubsystemID },
+	"serialNumber": func(device *nascrd.AllocatablePci) string { return device.SerialNumber },
+	"vendorName":   func(device *nascrd.AllocatablePci) string { return device.VendorName },
+	"deviceName":   func(device *nascrd.AllocatablePci) string { return device.DeviceName },
+	"driver":       func(device *nascrd.AllocatablePci) string { return device.Driver },
+	"iommuGroup":   func(device *nascrd.AllocatablePci) string { return device.IOMMUGroup },
+	"numaNode": func(device *nascrd.AllocatablePci) string {
+		if device.NumaNode == nil {
+			return ""
+		}
+		return strconv.Itoa(*device.NumaNode)
+	},
+	"linkSpeed": func(device *nascrd.AllocatablePci) string {
+		return strings.TrimSpace(strings.TrimSuffix(device.LinkSpeed, "GT/s"))
+	},
+	"linkWidth": func(device *nascrd.AllocatablePci) string {
+		if device.LinkWidth == 0 {
+			return ""
+		}
+		return strconv.Itoa(device.LinkWidth)
+	},
+	"rootComplex": func(device *nascrd.AllocatablePci) string { return device.RootComplex },
+}
+
+// numericDeviceAttributes are the attributes that can be compared with Gt and Lt.
+var numericDeviceAttributes = map[string]struct{}{
+	"numaNode":  {},
+	"linkSpeed": {},
+	"linkWidth": {},
+}
+
+// validateSelector checks that every requirement of a claim selector names a
+// known attribute and has the values its operator needs.
+func validateSelector(selector []pcicrd.DeviceAttributeRequirement) error {
+	for i, requirement := range selector {
+		if _, exists := deviceAttributes[requirement.Attribute]; !exists {
+			return fmt.Errorf("selector %d: unknown attribute: %s", i, requirement.Attribute)
+		}
+		switch requirement.Operator {
+		case pcicrd.InAttributeOperator, pcicrd.NotInAttributeOperator:
+			if len(requirement.Values) == 0 {
+				return fmt.Errorf("selector %d: operator %s needs values", i, requirement.Operator)
+			}
+		case pcicrd.ExistsAttributeOperator, pcicrd.DoesNotExistAttributeOperator:
+			if len(requirement.Values) != 0 {
+				return fmt.Errorf("selector %d: operator %s takes no values", i, requirement.Operator)
+			}
+		case pcicrd.GtAttributeOperator, pcicrd.LtAttributeOperator:
+			if _, numeric := numericDeviceAttributes[requirement.Attribute]; !numeric {
+				return fmt.Errorf("selector %d: operator %s does not apply to attribute %s", i, requirement.Operator, requirement.Attribute)
+			}
+			if len(requirement.Values) != 1 {
+				return fmt.Errorf("selector %d: operator %s needs exactly one value", i, requirement.Operator)
+			}
+			if _, err := strconv.ParseFloat(requirement.Values[0], 64); err != nil {
+				return fmt.Errorf("selector %d: operator %s needs a number: %s", i, requirement.Operator, requirement.Values[0])
+			}
+		default:
+			return fmt.Errorf("selector %d: unknown operator: %s", i, requirement.Operator)
+		}
+	}
+	return nil
+}
+
+// deviceMatchesSelector reports whether device satisfies every requirement of
+// a validated claim selector.
+func deviceMatchesSelector(device *nascrd.AllocatablePci, selector []pcicrd.DeviceAttributeRequirement) bool {
+	for _, requirement := range selector {
+		if !deviceMatchesRequirement(device, requirement) {
+			return false
+		}
+	}
+	return true
+}
+
+func deviceMatchesRequirement(device *nascrd.AllocatablePci, requirement pcicrd.DeviceAttributeRequirement) bool {
+	attribute, exists := deviceAttributes[requirement.Attribute]
+	if !exists {
+		return false
+	}
+	value := attribute(device)
+
+	switch requirement.Operator {
+	case pcicrd.InAttributeOperator:
+		return value != "" && containsFold(requirement.Values, value)
+	case pcicrd.NotInAttributeOperator:
+		return !containsFold(requirement.Values, value)
+	case pcicrd.ExistsAttributeOperator:
+		return value != ""
+	case pcicrd.DoesNotExistAttributeOperator:
+		return value == ""
+	case pcicrd.GtAttributeOperator, pcicrd.LtAttributeOperator:
+		actual, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return false
+		}
+		bound, err := strconv.ParseFloat(requirement.Values[0], 64)
+		if err != nil {
+			return false
+		}
+		if requirement.Operator == pcicrd.GtAttributeOperator {
+			return actual > bound
+		}
+		return actual < bound
+	}
+	return false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,292 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
+	resourcelisters "k8s.io/client-go/listers/resource/v1alpha2"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+
+	nascrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/nas/v1alpha1"
+	nasclient "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/nas/v1alpha1/client"
+	pcicrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/v1alpha1"
+)
+
+const (
+	discoveryConfigRetryPeriod = 10 * time.Second
+)
+
+// discoveryConfigPublisher resolves the device discovery configuration from the
+// resource classes of the driver and publishes it in the NodeAllocationState of
+// every node, so that the kubelet plugins never read cluster scoped objects.
+type discoveryConfigPublisher struct {
+	driver      *driver
+	classLister resourcelisters.ResourceClassLister
+	dcpInformer cache.SharedIndexInformer
+	nasInformer cache.SharedIndexInformer
+	trigger     chan struct{}
+}
+
+// StartDiscoveryConfigPublisher registers the informers the publisher needs
+// with informerFactory and starts publishing until ctx is done. The informer
+// factory must be started by the caller.
+func StartDiscoveryConfigPublisher(ctx context.Context, config *Config, driver *driver, informerFactory informers.SharedInformerFactory) error {
+	logger := klog.LoggerWithName(klog.FromContext(ctx), "discovery-config")
+	ctx = klog.NewContext(ctx, logger)
+
+	dcpClient := config.clientSets.Example.PciV1alpha1().DeviceClassParameters()
+	nasClient := config.clientSets.Example.NasV1alpha1().NodeAllocationStates(config.namespace)
+
+	p := &discoveryConfigPublisher{
+		driver:      driver,
+		classLister: informerFactory.Resource().V1alpha2().ResourceClasses().Lister(),
+		dcpInformer: cache.NewSharedIndexInformer(
+			&cache.ListWatch{
+				ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+					return dcpClient.List(ctx, options)
+				},
+				WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+					return dcpClient.Watch(ctx, options)
+				},
+			},
+			&pcicrd.DeviceClassParameters{},
+			0, /* resync period */
+			cache.Indexers{},
+		),
+		nasInformer: cache.NewSharedIndexInformer(
+			&cache.ListWatch{
+				ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+					return nasClient.List(ctx, options)
+				},
+				WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+					return nasClient.Watch(ctx, options)
+				},
+			},
+			&nascrd.NodeAllocationState{},
+			0, /* resync period */
+			cache.Indexers{},
+		),
+		trigger: make(chan struct{}, 1),
+	}
+
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { p.notify() },
+		UpdateFunc: func(oldObj, newObj interface{}) { p.notify() },
+		DeleteFunc: func(obj interface{}) { p.notify() },
+	}
+	classInformer := informerFactory.Resource().V1alpha2().ResourceClasses().Informer()
+	for _, informer := range []cache.SharedIndexInformer{classInformer, p.dcpInformer, p.nasInformer} {
+		_, err := informer.AddEventHandler(handler)
+		if err != nil {
+			return fmt.Errorf("add event handler: %v", err)
+		}
+	}
+
+	go p.dcpInformer.Run(ctx.Done())
+	go p.nasInformer.Run(ctx.Done())
+	go p.run(ctx, classInformer.HasSynced)
+
+	return nil
+}
+
+func (p *discoveryConfigPublisher) notify() {
+	select {
+	case p.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (p *discoveryConfigPublisher) run(ctx context.Context, classesSynced cache.InformerSynced) {
+	logger := klog.FromContext(ctx)
+
+	if !cache.WaitForCacheSync(ctx.Done(), classesSynced, p.dcpInformer.HasSynced, p.nasInformer.HasSynced) {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.trigger:
+		}
+
+		err := p.publish(ctx)
+		if err != nil {
+			logger.Error(err, "Unable to publish discovery config, retrying", "after", discoveryConfigRetryPeriod)
+			time.AfterFunc(discoveryConfigRetryPeriod, p.notify)
+		}
+	}
+}
+
+// publish writes the current discovery configuration into every
+// NodeAllocationState that does not carry it yet.
+func (p *discoveryConfigPublisher) publish(ctx context.Context) error {
+	discoveryConfig, err := p.resolve(ctx)
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	for _, obj := range p.nasInformer.GetStore().List() {
+		nas, ok := obj.(*nascrd.NodeAllocationState)
+		if !ok {
+			continue
+		}
+		if equality.Semantic.DeepEqual(nas.Spec.DiscoveryConfig, discoveryConfig) {
+			continue
+		}
+		err := p.publishToNode(ctx, nas.Name, discoveryConfig)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("node '%v': %v", nas.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("error updating discovery config: %v", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+func (p *discoveryConfigPublisher) publishToNode(ctx context.Context, node string, discoveryConfig *nascrd.DiscoveryConfig) error {
+	p.driver.lock.Get(node).Lock()
+	defer p.driver.lock.Get(node).Unlock()
+
+	crdconfig := &nascrd.NodeAllocationStateConfig{
+		Name:      node,
+		Namespace: p.driver.namespace,
+	}
+	crd := nascrd.NewNodeAllocationState(crdconfig)
+	client := nasclient.New(crd, p.driver.clientset.NasV1alpha1())
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		err := client.Get(ctx)
+		if err != nil {
+			return err
+		}
+		if equality.Semantic.DeepEqual(crd.Spec.DiscoveryConfig, discoveryConfig) {
+			return nil
+		}
+
+		spec := crd.Spec.DeepCopy()
+		spec.DiscoveryConfig = discoveryConfig.DeepCopy()
+		err = updateNodeAllocationState(ctx, client, &crd.Spec, spec)
+		if err != nil {
+			return err
+		}
+
+		klog.FromContext(ctx).Info("Published discovery config", "node", node, "numSelectors", len(discoveryConfig.Selectors))
+		return nil
+	})
+}
+
+// resolve merges the device selectors of all DeviceClassParameters referenced
+// by resource classes of this driver into a single, sorted discovery config.
+func (p *discoveryConfigPublisher) resolve(ctx context.Context) (*nascrd.DiscoveryConfig, error) {
+	logger := klog.FromContext(ctx)
+
+	classes, err := p.classLister.List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("error listing ResourceClasses: %v", err)
+	}
+
+	seen := make(map[string]struct{})
+	discoveryConfig := &nascrd.DiscoveryConfig{
+		Selectors: []nascrd.DiscoverySelector{},
+	}
+	for _, class := range classes {
+		if class.DriverName != DriverAPIGroup {
+			continue
+		}
+
+		classParams := pcicrd.DefaultDeviceClassParametersSpec()
+		if class.ParametersRef != nil {
+			if class.ParametersRef.APIGroup != DriverAPIGroup {
+				logger.Info("Skipping ResourceClass with parameters of an unknown API group", "class", class.Name, "apiGroup", class.ParametersRef.APIGroup)
+				continue
+			}
+			obj, exists, err := p.dcpInformer.GetStore().GetByKey(class.ParametersRef.Name)
+			if err != nil {
+				return nil, fmt.Errorf("error getting DeviceClassParameters called '%v': %v", class.ParametersRef.Name, err)
+			}
+			if !exists {
+				logger.Info("Skipping ResourceClass with missing DeviceClassParameters", "class", class.Name, "parameters", class.ParametersRef.Name)
+				continue
+			}
+			classParams = &obj.(*pcicrd.DeviceClassParameters).Spec
+		}
+
+		for _, device := range classParams.DeviceSelector {
+			if device.Type != nascrd.PciDeviceType {
+				continue
+			}
+			if err := device.PCISelector.Validate(); err != nil {
+				logger.Info("Skipping invalid device selector", "class", class.Name, "error", err)
+				continue
+			}
+			selector := nascrd.DiscoverySelector{
+				ResourceName: device.ResourceName,
+				PCISelector:  *device.PCISelector.DeepCopy(),
+				AutoBindVFIO: device.AutoBindVFIO,
+			}
+			selector.Normalize()
+			key := discoverySelectorKey(selector)
+			if _, exists := seen[key]; exists {
+				continue
+			}
+			seen[key] = struct{}{}
+			discoveryConfig.Selectors = append(discoveryConfig.Selectors, selector)
+		}
+	}
+
+	sort.Slice(discoveryConfig.Selectors, func(i, j int) bool {
+		a, b := discoveryConfig.Selectors[i], discoveryConfig.Selectors[j]
+		if a.ResourceName != b.ResourceName {
+			return a.ResourceName < b.ResourceName
+		}
+		return discoverySelectorKey(a) < discoverySelectorKey(b)
+	})
+
+	return discoveryConfig, nil
+}
+
+// discoverySelectorKey identifies a normalized selector by all its fields.
+func discoverySelectorKey(selector nascrd.DiscoverySelector) string {
+	return strings.Join([]string{
+		selector.ResourceName,
+		selector.PCIVendorSelector,
+		selector.PCIClassSelector,
+		selector.PCISubsystemSelector,
+		strings.Join(selector.PCIAddresses, ","),
+		strings.Join(selector.ExcludedPCIAddresses, ","),
+		strings.Join(selector.ExcludedSerialNumbers, ","),
+		strconv.FormatBool(selector.AutoBindVFIO),
+	}, "|")
+}
@@ -19,11 +19,14 @@ package main
 import (
 	"context"
 	"fmt"
+	"sort"
 
 	corev1 "k8s.io/api/core/v1"
 	resourcev1 "k8s.io/api/resource/v1alpha2"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
 	"k8s.io/dynamic-resource-allocation/controller"
+	"k8s.io/klog/v2"
 	pcicrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/v1alpha1"
 
 	nascrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/nas/v1alpha1"
@@ -66,6 +69,14 @@ func (d driver) GetClassParameters(ctx context.Context, class *resourcev1.Resour
 	if err != nil {
 		return nil, fmt.Errorf("error getting PciClassParameters called '%v': %v", class.ParametersRef.Name, err)
 	}
+	for _, selector := range dc.Spec.DeviceSelector {
+		if err := selector.PCISelector.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid device selector in PciClassParameters called '%v': %v", class.ParametersRef.Name, err)
+		}
+	}
+	if err := validateAllocationPolicy(&dc.Spec); err != nil {
+		return nil, fmt.Errorf("invalid PciClassParameters called '%v': %v", class.ParametersRef.Name, err)
+	}
 
 	return &dc.Spec, nil
 }
@@ -84,7 +95,8 @@ func (d driver) GetClaimParameters(ctx context.Context, claim *resourcev1.Resour
 		if err != nil {
 			return nil, fmt.Errorf("error getting PciClaimParameters called '%v' in namespace '%v': %v", claim.Spec.ParametersRef.Name, claim.Namespace, err)
 		}
-		err = d.pci.ValidateClaimParameters(&gc.Spec)
+		classParams, _ := classParameters.(*pcicrd.DeviceClassParametersSpec)
+		err = d.pci.ValidateClaimParameters(&gc.Spec, classParams)
 		if err != nil {
 			return nil, fmt.Errorf("error validating PciClaimParameters called '%v' in namespace '%v': %v", claim.Spec.ParametersRef.Name, claim.Namespace, err)
 		}
@@ -95,19 +107,25 @@ func (d driver) GetClaimParameters(ctx context.Context, claim *resourcev1.Resour
 }
 
 func (d driver) Allocate(ctx context.Context, cas []*controller.ClaimAllocation, selectedNode string) {
-
-	//TODO : Handle separately as d.allocateImmediateClaims and d.allocateMultiplePendingClaims
-	for _, ca := range cas {
-		ca.Allocation, ca.Error = d.allocate(ctx, ca.Claim, ca.ClaimParameters, ca.Class, ca.ClassParameters, selectedNode)
+	if selectedNode == "" {
+		d.allocateImmediateClaims(ctx, cas)
+		return
 	}
-
+	d.allocateMultiplePendingClaims(ctx, cas, selectedNode)
 }
 
-func (d driver) allocate(ctx context.Context, claim *resourcev1.ResourceClaim, claimParameters interface{}, class *resourcev1.ResourceClass, classParameters interface{}, selectedNode string) (*resourcev1.AllocationResult, error) {
-	if selectedNode == "" {
-		return nil, fmt.Errorf("TODO: immediate allocations is not yet supported")
+// allocateImmediateClaims allocates claims that were not scheduled together
+// with a pod. Each of them may end up on a different node.
+func (d driver) allocateImmediateClaims(ctx context.Context, cas []*controller.ClaimAllocation) {
+	for _, ca := range cas {
+		ca.Allocation, ca.Error = d.allocateImmediate(ctx, ca.Claim, ca.ClaimParameters, ca.Class, ca.ClassParameters)
 	}
+}
 
+// allocateMultiplePendingClaims allocates the claims of a pod on selectedNode
+// in a single read-modify-write of its NodeAllocationState. Either all claims
+// are allocated or, if any of them fails, none.
+func (d driver) allocateMultiplePendingClaims(ctx context.Context, cas []*controller.ClaimAllocation, selectedNode string) {
 	d.lock.Get(selectedNode).Lock()
 	defer d.lock.Get(selectedNode).Unlock()
 
@@ -116,46 +134,177 @@ func (d driver) allocate(ctx context.Context, claim *resourcev1.ResourceClaim, c
 		Namespace: d.namespace,
 	}
 	crd := nascrd.NewNodeAllocationState(crdconfig)
-
 	client := nasclient.New(crd, d.clientset.NasV1alpha1())
-	err := client.Get(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("error retrieving node specific Pci CRD: %v", err)
-	}
 
-	if crd.Status != nascrd.NodeAllocationStateStatusReady {
-		return nil, fmt.Errorf("NodeAllocationStateStatus: %v", crd.Status)
-	}
+	var onSuccess []OnSuccessCallback
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		onSuccess = nil
 
-	if crd.Spec.AllocatedClaims == nil {
-		crd.Spec.AllocatedClaims = make(map[string]nascrd.AllocatedDevices)
+		err := client.Get(ctx)
+		if err != nil {
+			return fmt.Errorf("error retrieving node specific Pci CRD: %v", err)
+		}
+
+		if crd.Status != nascrd.NodeAllocationStateStatusReady {
+			return fmt.Errorf("NodeAllocationStateStatus: %v", crd.Status)
+		}
+
+		current := crd.Spec.DeepCopy()
+		if crd.Spec.AllocatedClaims == nil {
+			crd.Spec.AllocatedClaims = make(map[string]nascrd.AllocatedDevices)
+		}
+
+		updated := false
+		for _, ca := range cas {
+			if _, exists := crd.Spec.AllocatedClaims[string(ca.Claim.UID)]; exists {
+				continue
+			}
+
+			callback, err := d.allocatePending(crd, ca, selectedNode)
+			if err != nil {
+				return fmt.Errorf("unable to allocate devices for claim '%v' on node '%v': %v", ca.Claim.UID, selectedNode, err)
+			}
+			onSuccess = append(onSuccess, callback)
+			updated = true
+		}
+		if !updated {
+			return nil
+		}
+
+		err = updateNodeAllocationState(ctx, client, current, &crd.Spec)
+		if err != nil {
+			return fmt.Errorf("error updating NodeAllocationState CRD: %w", err)
+		}
+		return nil
+	})
+
+	if err != nil {
+		for _, ca := range cas {
+			ca.Allocation, ca.Error = nil, err
+		}
+		return
 	}
 
-	if _, exists := crd.Spec.AllocatedClaims[string(claim.UID)]; exists {
-		return buildAllocationResult(selectedNode, true), nil
+	for _, callback := range onSuccess {
+		callback()
+	}
+	for _, ca := range cas {
+		ca.Allocation = buildAllocationResult(selectedNode, allocationShareable(crd.Spec.AllocatedClaims[string(ca.Claim.UID)]))
+		ca.Error = nil
 	}
+}
 
-	var onSuccess OnSuccessCallback
-	classParams, _ := classParameters.(*pcicrd.DeviceClassParametersSpec)
+// allocatePending moves the devices reserved for a claim on node while the
+// pod was being scheduled into crd.
+func (d driver) allocatePending(crd *nascrd.NodeAllocationState, ca *controller.ClaimAllocation, node string) (OnSuccessCallback, error) {
+	classParams, _ := ca.ClassParameters.(*pcicrd.DeviceClassParametersSpec)
 
-	switch claimParams := claimParameters.(type) {
+	switch claimParams := ca.ClaimParameters.(type) {
 	case *pcicrd.PciClaimParametersSpec:
-		onSuccess, err = d.pci.Allocate(crd, claim, claimParams, class, classParams, selectedNode)
+		return d.pci.Allocate(crd, ca.Claim, claimParams, ca.Class, classParams, node)
 	default:
-		err = fmt.Errorf("unknown ResourceClaim.ParametersRef.Kind: %v", claim.Spec.ParametersRef.Kind)
+		return nil, fmt.Errorf("unknown ResourceClaim.ParametersRef.Kind: %v", ca.Claim.Spec.ParametersRef.Kind)
 	}
+}
+
+func (d driver) allocateImmediate(ctx context.Context, claim *resourcev1.ResourceClaim, claimParameters interface{}, class *resourcev1.ResourceClass, classParameters interface{}) (*resourcev1.AllocationResult, error) {
+	nasList, err := d.clientset.NasV1alpha1().NodeAllocationStates(d.namespace).List(ctx, metav1.ListOptions{})
 	if err != nil {
-		return nil, fmt.Errorf("unable to allocate devices on node '%v': %v", selectedNode, err)
+		return nil, fmt.Errorf("error listing NodeAllocationStates: %v", err)
 	}
 
-	err = client.Update(ctx, &crd.Spec)
+	var nodes []string
+	for _, nas := range nasList.Items {
+		if allocation, exists := nas.Spec.AllocatedClaims[string(claim.UID)]; exists {
+			return buildAllocationResult(nas.Name, allocationShareable(allocation)), nil
+		}
+		nodes = append(nodes, nas.Name)
+	}
+	sort.Strings(nodes)
+
+	for _, node := range nodes {
+		allocation, err := d.allocateImmediateOnNode(ctx, claim, claimParameters, class, classParameters, node)
+		if err != nil {
+			return nil, err
+		}
+		if allocation != nil {
+			return allocation, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no ready node has a free device for claim '%v'", claim.UID)
+}
+
+// allocateImmediateOnNode tries to allocate the claim on node. It returns a nil
+// AllocationResult without an error if the node cannot satisfy the claim. The
+// allocation is retried from scratch if the NodeAllocationState of the node
+// changed in the meantime.
+func (d driver) allocateImmediateOnNode(ctx context.Context, claim *resourcev1.ResourceClaim, claimParameters interface{}, class *resourcev1.ResourceClass, classParameters interface{}, node string) (*resourcev1.AllocationResult, error) {
+	logger := klog.FromContext(ctx)
 
+	d.lock.Get(node).Lock()
+	defer d.lock.Get(node).Unlock()
+
+	crdconfig := &nascrd.NodeAllocationStateConfig{
+		Name:      node,
+		Namespace: d.namespace,
+	}
+	crd := nascrd.NewNodeAllocationState(crdconfig)
+	client := nasclient.New(crd, d.clientset.NasV1alpha1())
+
+	var result *resourcev1.AllocationResult
+	var onSuccess OnSuccessCallback
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		result, onSuccess = nil, nil
+
+		err := client.Get(ctx)
+		if err != nil {
+			return fmt.Errorf("error retrieving node specific Pci CRD: %v", err)
+		}
+
+		if crd.Status != nascrd.NodeAllocationStateStatusReady {
+			logger.V(5).Info("Skipping node for immediate allocation", "node", node, "status", crd.Status)
+			return nil
+		}
+
+		current := crd.Spec.DeepCopy()
+		if crd.Spec.AllocatedClaims == nil {
+			crd.Spec.AllocatedClaims = make(map[string]nascrd.AllocatedDevices)
+		}
+
+		if allocation, exists := crd.Spec.AllocatedClaims[string(claim.UID)]; exists {
+			result = buildAllocationResult(node, allocationShareable(allocation))
+			return nil
+		}
+
+		classParams, _ := classParameters.(*pcicrd.DeviceClassParametersSpec)
+
+		switch claimParams := claimParameters.(type) {
+		case *pcicrd.PciClaimParametersSpec:
+			onSuccess, err = d.pci.AllocateImmediate(crd, claim, claimParams, class, classParams, node)
+		default:
+			return fmt.Errorf("unknown ResourceClaim.ParametersRef.Kind: %v", claim.Spec.ParametersRef.Kind)
+		}
+		if err != nil {
+			logger.V(5).Info("Node unsuitable for immediate allocation", "node", node, "claim", claim.UID, "reason", err)
+			return nil
+		}
+
+		err = updateNodeAllocationState(ctx, client, current, &crd.Spec)
+		if err != nil {
+			return fmt.Errorf("error updating NodeAllocationState CRD: %w", err)
+		}
+		result = buildAllocationResult(node, allocationShareable(crd.Spec.AllocatedClaims[string(claim.UID)]))
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("error updating NodeAllocationState CRD: %v", err)
+		return nil, err
 	}
 
-	onSuccess()
-	return buildAllocationResult(selectedNode, true), nil
+	if onSuccess != nil {
+		onSuccess()
+	}
+	return result, nil
 }
 
 func (d driver) Deallocate(ctx context.Context, claim *resourcev1.ResourceClaim) error {
@@ -187,6 +336,7 @@ func (d driver) Deallocate(ctx context.Context, claim *resourcev1.ResourceClaim)
 		return nil
 	}
 
+	current := crd.Spec.DeepCopy()
 	devices := crd.Spec.AllocatedClaims[string(claim.UID)]
 
 	switch devices.Type() {
@@ -201,7 +351,7 @@ func (d driver) Deallocate(ctx context.Context, claim *resourcev1.ResourceClaim)
 
 	delete(crd.Spec.AllocatedClaims, string(claim.UID))
 
-	err = client.Update(ctx, &crd.Spec)
+	err = updateNodeAllocationState(ctx, client, current, &crd.Spec)
 	if err != nil {
 		return fmt.Errorf("error updating NodeAllocationState CRD: %v", err)
 	}
@@ -0,0 +1,85 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	resourcev1 "k8s.io/api/resource/v1alpha2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stesting "k8s.io/client-go/testing"
+
+	nascrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/nas/v1alpha1"
+	pcicrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/v1alpha1"
+	"kubevirt.io/dra-pci-driver/pkg/kubevirt.io/resource/clientset/versioned/fake"
+)
+
+func TestAllocateImmediateRetriesOnConflict(t *testing.T) {
+	nas := &nascrd.NodeAllocationState{
+		ObjectMeta: metav1.ObjectMeta{Name: "node01", Namespace: "dra-pci-driver"},
+		Spec:       *allocationSpec([]string{"dev-0", "dev-1"}, nil),
+		Status:     nascrd.NodeAllocationStateStatusReady,
+	}
+	clientset := fake.NewSimpleClientset(nas)
+
+	// Another allocation takes dev-0 while the first update is in flight.
+	conflicts := 0
+	clientset.PrependReactor("update", "nodeallocationstates", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicts > 0 {
+			return false, nil, nil
+		}
+		conflicts++
+		other := nas.DeepCopy()
+		other.Spec.AllocatedClaims["claim-other"] = pendingDevices("dev-0")
+		err := clientset.Tracker().Update(nascrd.SchemeGroupVersion.WithResource("nodeallocationstates"), other, other.Namespace)
+		if err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "nodeallocationstates"}, nas.Name, nil)
+	})
+
+	d := driver{
+		lock:      NewPerNodeMutex(),
+		namespace: nas.Namespace,
+		clientset: clientset,
+		pci:       NewPciDriver(),
+	}
+	claim := &resourcev1.ResourceClaim{ObjectMeta: metav1.ObjectMeta{UID: "claim"}}
+	allocation, err := d.allocateImmediateOnNode(context.Background(), claim, pcicrd.DefaultPciClaimParametersSpec(), nil, pcicrd.DefaultDeviceClassParametersSpec(), nas.Name)
+	if err != nil {
+		t.Fatalf("allocateImmediateOnNode: %v", err)
+	}
+	if allocation == nil {
+		t.Fatalf("allocateImmediateOnNode allocated nothing")
+	}
+
+	updated, err := clientset.NasV1alpha1().NodeAllocationStates(nas.Namespace).Get(context.Background(), nas.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	want := map[string]nascrd.AllocatedDevices{
+		"claim-other": pendingDevices("dev-0"),
+		"claim":       buildAllocatedDevices([]string{"dev-1"}, pcicrd.DefaultPciClaimParametersSpec(), pcicrd.DefaultDeviceClassParametersSpec()),
+	}
+	if !reflect.DeepEqual(updated.Spec.AllocatedClaims, want) {
+		t.Errorf("allocated claims %+v, want %+v", updated.Spec.AllocatedClaims, want)
+	}
+}
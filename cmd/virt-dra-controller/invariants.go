@@ -0,0 +1,59 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	nascrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/nas/v1alpha1"
+	nasclient "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/nas/v1alpha1/client"
+)
+
+// updateNodeAllocationState writes spec through client unless doing so would
+// break the allocation invariants. current is the spec as it was read from the
+// API server.
+func updateNodeAllocationState(ctx context.Context, client *nasclient.Client, current *nascrd.NodeAllocationStateSpec, spec *nascrd.NodeAllocationStateSpec) error {
+	err := checkAllocationInvariants(current, spec)
+	if err != nil {
+		return err
+	}
+	return client.Update(ctx, spec)
+}
+
+// checkAllocationInvariants fails if updated violates an allocation invariant
+// that current does not. Violations that are already stored are tolerated, so
+// that claims can still be deallocated from a node in a bad state.
+func checkAllocationInvariants(current *nascrd.NodeAllocationStateSpec, updated *nascrd.NodeAllocationStateSpec) error {
+	existing := make(map[string]struct{})
+	for _, violation := range current.AllocationViolations() {
+		existing[violation] = struct{}{}
+	}
+
+	var introduced []string
+	for _, violation := range updated.AllocationViolations() {
+		if _, exists := existing[violation]; !exists {
+			introduced = append(introduced, violation)
+		}
+	}
+	if len(introduced) > 0 {
+		return fmt.Errorf("refusing to update NodeAllocationState: %s", strings.Join(introduced, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"testing"
+
+	nascrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/nas/v1alpha1"
+)
+
+func allocationSpec(allocatable []string, claims map[string][]string) *nascrd.NodeAllocationStateSpec {
+	spec := &nascrd.NodeAllocationStateSpec{
+		AllocatedClaims: make(map[string]nascrd.AllocatedDevices),
+	}
+	for _, uuid := range allocatable {
+		spec.AllocatableDevices = append(spec.AllocatableDevices, nascrd.AllocatableDevice{Pci: &nascrd.AllocatablePci{UUID: uuid}})
+	}
+	for claimUID, uuids := range claims {
+		allocated := nascrd.AllocatedDevices{Pci: &nascrd.AllocatedPcis{}}
+		for _, uuid := range uuids {
+			allocated.Pci.Devices = append(allocated.Pci.Devices, nascrd.AllocatedPci{UUID: uuid})
+		}
+		spec.AllocatedClaims[claimUID] = allocated
+	}
+	return spec
+}
+
+func TestCheckAllocationInvariants(t *testing.T) {
+	tests := []struct {
+		name    string
+		current *nascrd.NodeAllocationStateSpec
+		updated *nascrd.NodeAllocationStateSpec
+		wantErr string
+	}{
+		{
+			name:    "valid allocation",
+			current: allocationSpec([]string{"dev-a", "dev-b"}, map[string][]string{"claim-1": {"dev-a"}}),
+			updated: allocationSpec([]string{"dev-a", "dev-b"}, map[string][]string{"claim-1": {"dev-a"}, "claim-2": {"dev-b"}}),
+		},
+		{
+			name:    "device not allocatable",
+			current: allocationSpec([]string{"dev-a"}, nil),
+			updated: allocationSpec([]string{"dev-a"}, map[string][]string{"claim-1": {"dev-gone"}}),
+			wantErr: "refusing to update NodeAllocationState: device dev-gone of claim claim-1 is not allocatable",
+		},
+		{
+			name:    "device in two claims",
+			current: allocationSpec([]string{"dev-a"}, map[string][]string{"claim-1": {"dev-a"}}),
+			updated: allocationSpec([]string{"dev-a"}, map[string][]string{"claim-1": {"dev-a"}, "claim-2": {"dev-a"}}),
+			wantErr: "refusing to update NodeAllocationState: device dev-a is allocated to claims claim-1 and claim-2",
+		},
+		{
+			name:    "pre-existing violation is tolerated",
+			current: allocationSpec([]string{"dev-a"}, map[string][]string{"claim-1": {"dev-a"}, "claim-2": {"dev-a"}}),
+			updated: allocationSpec([]string{"dev-a"}, map[string][]string{"claim-1": {"dev-a"}, "claim-2": {"dev-a"}}),
+		},
+		{
+			name:    "deallocation from a node with a violation",
+			current: allocationSpec([]string{"dev-a"}, map[string][]string{"claim-1": {"dev-a"}, "claim-2": {"dev-a"}}),
+			updated: allocationSpec([]string{"dev-a"}, map[string][]string{"claim-1": {"dev-a"}}),
+		},
+		{
+			name:    "new violation next to a pre-existing one",
+			current: allocationSpec([]string{"dev-a", "dev-b"}, map[string][]string{"claim-1": {"dev-a"}, "claim-2": {"dev-a"}}),
+			updated: allocationSpec([]string{"dev-a", "dev-b"}, map[string][]string{"claim-1": {"dev-a"}, "claim-2": {"dev-a"}, "claim-3": {"dev-b"}, "claim-4": {"dev-b"}}),
+			wantErr: "refusing to update NodeAllocationState: device dev-b is allocated to claims claim-3 and claim-4",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkAllocationInvariants(tt.current, tt.updated)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkAllocationInvariants() = %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("checkAllocationInvariants() = %v, want error %q", err, tt.wantErr)
+			}
+		})
+	}
+}
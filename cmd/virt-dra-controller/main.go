@@ -24,6 +24,7 @@ import (
 	"net/http/pprof"
 	"os"
 	"path"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -46,7 +47,8 @@ type Flags struct {
 	loggingConfig    *flags.LoggingConfig
 	nasConfig        flags.NasConfig
 
-	workers int
+	workers              int
+	pendingAllocationTTL time.Duration
 
 	httpEndpoint string
 	metricsPath  string
@@ -79,6 +81,13 @@ func newApp() *cli.App {
 			Destination: &flags.workers,
 			EnvVars:     []string{"WORKERS"},
 		},
+		&cli.DurationFlag{
+			Name:        "pending-allocation-ttl",
+			Usage:       "How long devices stay reserved for a pod being scheduled without the scheduler asking for the node again, 0 to keep them until the pod is scheduled or deleted",
+			Value:       5 * time.Minute,
+			Destination: &flags.pendingAllocationTTL,
+			EnvVars:     []string{"PENDING_ALLOCATION_TTL"},
+		},
 
 		&cli.StringFlag{
 			Category:    "HTTP server:",
@@ -214,6 +223,14 @@ func StartController(ctx context.Context, config *Config) error {
 	}
 	informerFactory := informers.NewSharedInformerFactory(config.clientSets.Core, 0 /* resync period */)
 	ctrl := controller.New(ctx, DriverAPIGroup, driver, config.clientSets.Core, informerFactory)
+	err = StartDiscoveryConfigPublisher(ctx, config, driver, informerFactory)
+	if err != nil {
+		return fmt.Errorf("start discovery config publisher: %v", err)
+	}
+	err = StartPendingAllocationCollector(ctx, config, driver, informerFactory)
+	if err != nil {
+		return fmt.Errorf("start pending allocation collector: %v", err)
+	}
 	informerFactory.Start(ctx.Done())
 	ctrl.Run(config.flags.workers)
 	return nil
@@ -0,0 +1,66 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const metricsSubsystem = "virt_dra_controller"
+
+// Reasons for dropping pending allocations other than their claim being
+// allocated or deallocated.
+const (
+	pendingAllocationExpired         = "expired"
+	pendingAllocationNodeNotSelected = "node_not_selected"
+	pendingAllocationPodGone         = "pod_gone"
+)
+
+var (
+	pendingAllocationsGauge = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "pending_allocations",
+			Help:           "Number of claims with devices tentatively reserved on a node while their pod is being scheduled.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"node"},
+	)
+	pendingAllocatedDevicesGauge = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "pending_allocated_devices",
+			Help:           "Number of devices tentatively reserved on a node while pods are being scheduled.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"node"},
+	)
+	pendingAllocationsDroppedCounter = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "pending_allocations_dropped_total",
+			Help:           "Number of pending allocations dropped before their claim was allocated, by reason.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	legacyregistry.MustRegister(pendingAllocationsGauge, pendingAllocatedDevicesGauge, pendingAllocationsDroppedCounter)
+}
@@ -18,14 +18,18 @@ package main
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 
 	pcicrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/v1alpha1"
 
 	corev1 "k8s.io/api/core/v1"
 	resourcev1 "k8s.io/api/resource/v1alpha2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/dynamic-resource-allocation/controller"
 
 	nascrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/nas/v1alpha1"
+	"kubevirt.io/dra-pci-driver/pkg/util"
 )
 
 type pcidriver struct {
@@ -38,9 +42,75 @@ func NewPciDriver() *pcidriver {
 	}
 }
 
-func (p *pcidriver) ValidateClaimParameters(claimParams *pcicrd.PciClaimParametersSpec) error {
-	if claimParams.DeviceName != "devices.kubevirt.io/nvme" {
-		return fmt.Errorf("unsupported pci device type: %s", claimParams.DeviceName)
+func (p *pcidriver) ValidateClaimParameters(claimParams *pcicrd.PciClaimParametersSpec, classParams *pcicrd.DeviceClassParametersSpec) error {
+	if claimParams.DeviceName == "" {
+		return fmt.Errorf("deviceName must be set")
+	}
+	if classParams == nil {
+		classParams = pcicrd.DefaultDeviceClassParametersSpec()
+	}
+
+	var allowed []string
+	supported := false
+	for _, selector := range classParams.DeviceSelector {
+		if selector.Type != nascrd.PciDeviceType {
+			continue
+		}
+		allowed = append(allowed, selector.ResourceName)
+		if util.MatchesWildcard(selector.ResourceName, claimParams.DeviceName) || util.MatchesWildcard(claimParams.DeviceName, selector.ResourceName) {
+			supported = true
+		}
+	}
+	if !supported {
+		return fmt.Errorf("unsupported pci device name '%s', the resource class allows: [%s]", claimParams.DeviceName, strings.Join(allowed, ", "))
+	}
+
+	switch claimParams.AllocationMode {
+	case "", pcicrd.ExactCountAllocationMode:
+		if claimParams.Count < 0 {
+			return fmt.Errorf("invalid device count: %d", claimParams.Count)
+		}
+	case pcicrd.AllAllocationMode:
+		if claimParams.Count != 0 {
+			return fmt.Errorf("count cannot be set with allocation mode %s", pcicrd.AllAllocationMode)
+		}
+	default:
+		return fmt.Errorf("unknown allocation mode: %s", claimParams.AllocationMode)
+	}
+
+	switch claimParams.Sharing {
+	case "", pcicrd.ExclusiveSharing:
+		if claimParams.MaxConsumers != 0 {
+			return fmt.Errorf("maxConsumers can only be set with sharing %s", pcicrd.SharedSharing)
+		}
+	case pcicrd.SharedSharing:
+		if claimParams.MaxConsumers < 0 || claimParams.MaxConsumers > resourcev1.ResourceClaimReservedForMaxSize {
+			return fmt.Errorf("invalid maxConsumers: %d, must be between 0 and %d", claimParams.MaxConsumers, resourcev1.ResourceClaimReservedForMaxSize)
+		}
+	default:
+		return fmt.Errorf("unknown sharing: %s", claimParams.Sharing)
+	}
+
+	switch claimParams.PCIeLocality {
+	case "", pcicrd.SwitchPCIeLocality, pcicrd.RootPortPCIeLocality, pcicrd.RootComplexPCIeLocality:
+	default:
+		return fmt.Errorf("unknown PCIe locality: %s", claimParams.PCIeLocality)
+	}
+
+	if claimParams.NUMA != nil {
+		if claimParams.NUMA.Node < 0 {
+			return fmt.Errorf("invalid NUMA node: %d", claimParams.NUMA.Node)
+		}
+		switch claimParams.NUMA.Policy {
+		case "", pcicrd.RequiredNUMAPolicy, pcicrd.PreferredNUMAPolicy:
+		default:
+			return fmt.Errorf("unknown NUMA policy: %s", claimParams.NUMA.Policy)
+		}
+	}
+
+	err := validateSelector(claimParams.Selector)
+	if err != nil {
+		return fmt.Errorf("invalid selector: %v", err)
 	}
 	return nil
 }
@@ -48,11 +118,12 @@ func (p *pcidriver) ValidateClaimParameters(claimParams *pcicrd.PciClaimParamete
 func (p *pcidriver) Allocate(crd *nascrd.NodeAllocationState, claim *resourcev1.ResourceClaim, claimParams *pcicrd.PciClaimParametersSpec, class *resourcev1.ResourceClass, classParams *pcicrd.DeviceClassParametersSpec, selectedNode string) (OnSuccessCallback, error) {
 	claimUID := string(claim.UID)
 
-	if !p.PendingAllocatedClaims.Exists(claimUID, selectedNode) {
+	allocation, exists := p.PendingAllocatedClaims.Get(claimUID, selectedNode)
+	if !exists {
 		return nil, fmt.Errorf("no allocations generated for claim '%v' on node '%v' yet", claim.UID, selectedNode)
 	}
 
-	crd.Spec.AllocatedClaims[claimUID] = p.PendingAllocatedClaims.Get(claimUID, selectedNode)
+	crd.Spec.AllocatedClaims[claimUID] = allocation
 	onSuccess := func() {
 		p.PendingAllocatedClaims.Remove(claimUID)
 	}
@@ -60,22 +131,90 @@ func (p *pcidriver) Allocate(crd *nascrd.NodeAllocationState, claim *resourcev1.
 	return onSuccess, nil
 }
 
+// AllocateImmediate picks devices on node for a claim that was not scheduled
+// together with a pod. Devices tentatively reserved for pending claims on the
+// node are left alone.
+func (p *pcidriver) AllocateImmediate(crd *nascrd.NodeAllocationState, claim *resourcev1.ResourceClaim, claimParams *pcicrd.PciClaimParametersSpec, class *resourcev1.ResourceClass, classParams *pcicrd.DeviceClassParametersSpec, node string) (OnSuccessCallback, error) {
+	claimUID := string(claim.UID)
+
+	reserved := crd.DeepCopy()
+	p.PendingAllocatedClaims.VisitNode(node, func(pendingClaimUID string, allocation nascrd.AllocatedDevices) {
+		if _, exists := reserved.Spec.AllocatedClaims[pendingClaimUID]; !exists {
+			reserved.Spec.AllocatedClaims[pendingClaimUID] = allocation
+		}
+	})
+
+	ca := &controller.ClaimAllocation{
+		Claim:           claim,
+		Class:           class,
+		ClaimParameters: claimParams,
+		ClassParameters: classParams,
+	}
+	cas := []*controller.ClaimAllocation{ca}
+	allocated := p.allocate(reserved, nil, cas, cas, node)
+
+	if len(allocated[claimUID]) == 0 {
+		return nil, fmt.Errorf("not enough free '%v' devices on node '%v'", claimParams.DeviceName, node)
+	}
+
+	crd.Spec.AllocatedClaims[claimUID] = buildAllocatedDevices(allocated[claimUID], claimParams, classParams)
+	onSuccess := func() {}
+
+	return onSuccess, nil
+}
+
+// Deallocate drops the pending reservations of a claim and records when its
+// devices were released for the LeastRecentlyUsed allocation policy.
 func (p *pcidriver) Deallocate(crd *nascrd.NodeAllocationState, claim *resourcev1.ResourceClaim) error {
 	claimUID := string(claim.UID)
 	p.PendingAllocatedClaims.Remove(claimUID)
+
+	allocation, exists := crd.Spec.AllocatedClaims[claimUID]
+	if !exists || allocation.Type() != nascrd.PciDeviceType {
+		return nil
+	}
+	if crd.Spec.DeviceReleaseTimes == nil {
+		crd.Spec.DeviceReleaseTimes = make(map[string]metav1.Time)
+	}
+	now := metav1.Now()
+	for _, device := range allocation.Pci.Devices {
+		crd.Spec.DeviceReleaseTimes[device.UUID] = now
+	}
+
+	// Forget devices that are gone from the node.
+	allocatable := make(map[string]struct{})
+	for _, device := range crd.Spec.AllocatableDevices {
+		if device.Type() == nascrd.PciDeviceType {
+			allocatable[device.Pci.UUID] = struct{}{}
+		}
+	}
+	for uuid := range crd.Spec.DeviceReleaseTimes {
+		if _, exists := allocatable[uuid]; !exists {
+			delete(crd.Spec.DeviceReleaseTimes, uuid)
+		}
+	}
+
 	return nil
 }
 
 func (p *pcidriver) UnsuitableNode(crd *nascrd.NodeAllocationState, pod *corev1.Pod, pcicas []*controller.ClaimAllocation, allcas []*controller.ClaimAllocation, potentialNode string) error {
+	err := validatePodPlacement(pod)
+	if err != nil {
+		return err
+	}
 
 	// Visit the node and update the allocated claims
+	var allocatedClaimUIDs []string
 	p.PendingAllocatedClaims.VisitNode(potentialNode, func(claimUID string, allocation nascrd.AllocatedDevices) {
 		if _, exists := crd.Spec.AllocatedClaims[claimUID]; exists {
-			p.PendingAllocatedClaims.Remove(claimUID)
+			allocatedClaimUIDs = append(allocatedClaimUIDs, claimUID)
 		} else {
 			crd.Spec.AllocatedClaims[claimUID] = allocation
 		}
 	})
+	for _, claimUID := range allocatedClaimUIDs {
+		p.PendingAllocatedClaims.Remove(claimUID)
+	}
 
 	// Allocate resources
 	allocated := p.allocate(crd, pod, pcicas, allcas, potentialNode)
@@ -83,76 +222,304 @@ func (p *pcidriver) UnsuitableNode(crd *nascrd.NodeAllocationState, pod *corev1.
 	// Iterate over the PCI claim allocations
 	for _, ca := range pcicas {
 		claimUID := string(ca.Claim.UID)
-		_, ok := ca.ClaimParameters.(*pcicrd.PciClaimParametersSpec)
+		claimParams, ok := ca.ClaimParameters.(*pcicrd.PciClaimParametersSpec)
 		if !ok {
 			return fmt.Errorf("invalid claim parameters for claim UID: %s", claimUID)
 		}
+		classParams, _ := ca.ClassParameters.(*pcicrd.DeviceClassParametersSpec)
 
-		// Check if there is exactly one allocated device
-		if len(allocated[claimUID]) != 1 {
+		// Check if all requested devices could be allocated
+		if len(allocated[claimUID]) == 0 {
 			for _, ca := range allcas {
 				ca.UnsuitableNodes = append(ca.UnsuitableNodes, potentialNode)
 			}
 			return nil
 		}
 
-		// Prepare the allocated device
-		device := nascrd.AllocatedPci{
-			UUID: allocated[claimUID][0],
-		}
-
-		// Create the allocated devices structure
-		allocatedDevices := nascrd.AllocatedDevices{
-			Pci: &nascrd.AllocatedPcis{
-				Devices: []nascrd.AllocatedPci{device},
-			},
-		}
-
 		// Set the pending allocated claims
-		p.PendingAllocatedClaims.Set(claimUID, potentialNode, allocatedDevices)
+		p.PendingAllocatedClaims.Set(claimUID, potentialNode, podKey(pod), buildAllocatedDevices(allocated[claimUID], claimParams, classParams))
 	}
 
 	return nil
 }
 
 func (p *pcidriver) allocate(crd *nascrd.NodeAllocationState, pod *corev1.Pod, pcicas []*controller.ClaimAllocation, allcas []*controller.ClaimAllocation, node string) map[string][]string {
+	// All claims of the pod have to be satisfied by the devices of a single
+	// placement domain, try them one after the other.
+	used := p.usedDevices(crd, node)
+	for _, domain := range podPlacementDomains(crd.Spec.AllocatableDevices, pod) {
+		allocated := p.allocateInDomain(crd, pcicas, domain, used)
+		satisfied := true
+		for _, ca := range pcicas {
+			if len(allocated[string(ca.Claim.UID)]) == 0 {
+				satisfied = false
+				break
+			}
+		}
+		if satisfied {
+			return allocated
+		}
+	}
+
+	return make(map[string][]string)
+}
+
+// usedDevices returns the UUIDs of the devices on node that are allocated to a
+// claim or tentatively reserved for a pending claim.
+func (p *pcidriver) usedDevices(crd *nascrd.NodeAllocationState, node string) map[string]struct{} {
+	used := make(map[string]struct{})
+	add := func(_ string, allocation nascrd.AllocatedDevices) {
+		if allocation.Type() != nascrd.PciDeviceType {
+			return
+		}
+		for _, device := range allocation.Pci.Devices {
+			used[device.UUID] = struct{}{}
+		}
+	}
+
+	for claimUID, allocation := range crd.Spec.AllocatedClaims {
+		add(claimUID, allocation)
+	}
+	p.PendingAllocatedClaims.VisitNode(node, add)
+
+	return used
+}
 
+// allocateInDomain picks devices for the claims among the devices in domain
+// that are not used. Claims that are already allocated must lie within domain
+// as well.
+func (p *pcidriver) allocateInDomain(crd *nascrd.NodeAllocationState, pcicas []*controller.ClaimAllocation, domain placementDomain, used map[string]struct{}) map[string][]string {
+	devices := make(map[string]*nascrd.AllocatablePci)
 	available := make(map[string]*nascrd.AllocatablePci)
 
 	for _, device := range crd.Spec.AllocatableDevices {
 		if device.Type() != nascrd.PciDeviceType {
 			continue
 		}
-		if _, exist := crd.Spec.AllocatedClaims[device.Pci.UUID]; exist {
+		devices[device.Pci.UUID] = device.Pci
+		if device.Pci.UnavailableReason != "" {
+			continue
+		}
+		if _, inUse := used[device.Pci.UUID]; inUse {
 			continue
 		}
 		available[device.Pci.UUID] = device.Pci
 	}
 
+	units := allocationUnits(crd.Spec.AllocatableDevices)
+
+	usage := &nodeUsage{
+		devices:      devices,
+		used:         make(map[string]struct{}),
+		releaseTimes: crd.Spec.DeviceReleaseTimes,
+	}
+	for uuid := range used {
+		usage.used[uuid] = struct{}{}
+	}
+
 	allocated := make(map[string][]string)
 
 	for _, ca := range pcicas {
 		claimUID := string(ca.Claim.UID)
 
 		if v, exists := crd.Spec.AllocatedClaims[claimUID]; exists {
-			devices := v.Pci.Devices
-			for _, device := range devices {
-				allocated[claimUID] = append(allocated[claimUID], device.UUID)
+			var uuids []string
+			inDomain := true
+			for _, device := range v.Pci.Devices {
+				uuids = append(uuids, device.UUID)
+				if devices[device.UUID] == nil || !domain(devices[device.UUID]) {
+					inDomain = false
+				}
+			}
+			if inDomain {
+				allocated[claimUID] = uuids
 			}
 			continue
 		}
 
 		claimParams, _ := ca.ClaimParameters.(*pcicrd.PciClaimParametersSpec)
+		classParams, _ := ca.ClassParameters.(*pcicrd.DeviceClassParametersSpec)
 
-		for uuid, device := range available {
-			// Check if the device type is the one requested
-			if device.ResourceName == claimParams.DeviceName {
-				allocated[claimUID] = []string{device.UUID}
-				delete(available, uuid)
-				break
+		var candidates [][]*nascrd.AllocatablePci
+		for _, unit := range units {
+			if !unitMatchesClaim(unit, available, claimParams, classParams) {
+				continue
+			}
+			if !unitInDomain(unit, domain) {
+				continue
+			}
+			if claimParams.NUMA != nil && claimParams.NUMA.Policy != pcicrd.PreferredNUMAPolicy && !unitOnNUMANode(unit, claimParams.NUMA.Node) {
+				continue
+			}
+			candidates = append(candidates, unit)
+		}
+		candidates = classPolicy(classParams).order(candidates, usage)
+		if claimParams.NUMA != nil && claimParams.NUMA.Policy == pcicrd.PreferredNUMAPolicy {
+			sort.SliceStable(candidates, func(i, j int) bool {
+				return unitOnNUMANode(candidates[i], claimParams.NUMA.Node) && !unitOnNUMANode(candidates[j], claimParams.NUMA.Node)
+			})
+		}
+
+		if claimParams.PCIeLocality != "" {
+			candidates = localCandidates(candidates, claimParams, classParams)
+		}
+
+		// Only reserve devices if the whole request can be satisfied
+		selected := candidates
+		if claimParams.AllocationMode != pcicrd.AllAllocationMode {
+			selected = selectUnits(candidates, claimParams, classParams)
+		}
+		if len(selected) == 0 {
+			continue
+		}
+
+		for _, unit := range selected {
+			for _, device := range unit {
+				allocated[claimUID] = append(allocated[claimUID], device.UUID)
+				delete(available, device.UUID)
+				usage.used[device.UUID] = struct{}{}
 			}
 		}
 	}
 
 	return allocated
 }
+
+// allocationUnits partitions the devices into sets that must be allocated
+// together: the devices sharing an IOMMU group, as VFIO hands the whole group
+// to a single VM. Functions of a multi-function device that isolates them with
+// ACS, like the VFs of an SR-IOV device, are in groups of their own and are
+// allocated individually. Devices without a known group are units on their
+// own.
+func allocationUnits(devices []nascrd.AllocatableDevice) [][]*nascrd.AllocatablePci {
+	var units [][]*nascrd.AllocatablePci
+	index := make(map[string]int)
+	for _, device := range devices {
+		if device.Type() != nascrd.PciDeviceType {
+			continue
+		}
+		if device.Pci.IOMMUGroup == "" {
+			units = append(units, []*nascrd.AllocatablePci{device.Pci})
+			continue
+		}
+		i, exists := index[device.Pci.IOMMUGroup]
+		if !exists {
+			i = len(units)
+			index[device.Pci.IOMMUGroup] = i
+			units = append(units, nil)
+		}
+		units[i] = append(units[i], device.Pci)
+	}
+	return units
+}
+
+// unitMatchesClaim reports whether every device of unit is available and at
+// least one of them is handed out for the claim, i.e. is the device type
+// requested by the claim, selected by the resource class and satisfies the
+// selector of the claim. The other devices of the unit are allocated along
+// with it, as they can only be passed to the same VM.
+func unitMatchesClaim(unit []*nascrd.AllocatablePci, available map[string]*nascrd.AllocatablePci, claimParams *pcicrd.PciClaimParametersSpec, classParams *pcicrd.DeviceClassParametersSpec) bool {
+	for _, device := range unit {
+		if _, exists := available[device.UUID]; !exists {
+			return false
+		}
+	}
+	return matchingDevices(unit, claimParams, classParams) > 0
+}
+
+// matchingDevices returns the number of devices of unit that are handed out
+// for the claim. Only these count towards the devices requested by the claim.
+func matchingDevices(unit []*nascrd.AllocatablePci, claimParams *pcicrd.PciClaimParametersSpec, classParams *pcicrd.DeviceClassParametersSpec) int {
+	matching := 0
+	for _, device := range unit {
+		if util.MatchesWildcard(claimParams.DeviceName, device.ResourceName) &&
+			deviceMatchesClass(device, classParams) &&
+			deviceMatchesSelector(device, claimParams.Selector) {
+			matching++
+		}
+	}
+	return matching
+}
+
+// selectUnits picks candidate units in order until they hold exactly the
+// number of matching devices requested by the claim, skipping units that
+// would exceed it. It returns nil if the request can not be satisfied.
+func selectUnits(candidates [][]*nascrd.AllocatablePci, claimParams *pcicrd.PciClaimParametersSpec, classParams *pcicrd.DeviceClassParametersSpec) [][]*nascrd.AllocatablePci {
+	count := requestedDeviceCount(claimParams)
+	var selected [][]*nascrd.AllocatablePci
+	for _, unit := range candidates {
+		if count == 0 {
+			break
+		}
+		matching := matchingDevices(unit, claimParams, classParams)
+		if matching > count {
+			continue
+		}
+		selected = append(selected, unit)
+		count -= matching
+	}
+	if count > 0 {
+		return nil
+	}
+	return selected
+}
+
+// deviceMatchesClass reports whether any of the device selectors of the
+// resource class selects device.
+func deviceMatchesClass(device *nascrd.AllocatablePci, classParams *pcicrd.DeviceClassParametersSpec) bool {
+	if classParams == nil {
+		classParams = pcicrd.DefaultDeviceClassParametersSpec()
+	}
+	for _, selector := range classParams.DeviceSelector {
+		if selector.Type != nascrd.PciDeviceType {
+			continue
+		}
+		if !util.MatchesWildcard(selector.ResourceName, device.ResourceName) {
+			continue
+		}
+		if !selector.Matches(device.PciAddress, device.PciID, device.ClassCode, device.SubsystemID) {
+			continue
+		}
+		if selector.Excludes(device.PciAddress, device.SerialNumber) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// requestedDeviceCount returns the number of devices a claim in ExactCount
+// mode asks for.
+func requestedDeviceCount(claimParams *pcicrd.PciClaimParametersSpec) int {
+	if claimParams.Count == 0 {
+		return 1
+	}
+	return claimParams.Count
+}
+
+// buildAllocatedDevices records the devices allocated to a claim together
+// with the sharing semantics of the claim, which the kubelet plugin enforces,
+// and the allocation policy that picked them.
+func buildAllocatedDevices(uuids []string, claimParams *pcicrd.PciClaimParametersSpec, classParams *pcicrd.DeviceClassParametersSpec) nascrd.AllocatedDevices {
+	devices := make([]nascrd.AllocatedPci, 0, len(uuids))
+	for _, uuid := range uuids {
+		devices = append(devices, nascrd.AllocatedPci{UUID: uuid})
+	}
+	allocation := nascrd.AllocatedDevices{
+		Pci: &nascrd.AllocatedPcis{
+			Devices:          devices,
+			AllocationPolicy: classAllocationPolicy(classParams),
+		},
+	}
+	if claimParams.Sharing == pcicrd.SharedSharing {
+		allocation.Pci.Shareable = true
+		allocation.Pci.MaxConsumers = claimParams.MaxConsumers
+	}
+	return allocation
+}
+
+// allocationShareable reports whether the claim allocated allocation may be
+// reserved by more than one pod.
+func allocationShareable(allocation nascrd.AllocatedDevices) bool {
+	return allocation.Type() == nascrd.PciDeviceType && allocation.Pci.Shareable
+}
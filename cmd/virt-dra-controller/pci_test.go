@@ -0,0 +1,147 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	resourcev1 "k8s.io/api/resource/v1alpha2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/dynamic-resource-allocation/controller"
+
+	nascrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/nas/v1alpha1"
+	pcicrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/v1alpha1"
+)
+
+// testClaimAllocation returns the allocation of a claim asking for count
+// devices of any resource class.
+func testClaimAllocation(claimUID string, count int) *controller.ClaimAllocation {
+	claimParams := pcicrd.DefaultPciClaimParametersSpec()
+	claimParams.Count = count
+	return &controller.ClaimAllocation{
+		Claim:           &resourcev1.ResourceClaim{ObjectMeta: metav1.ObjectMeta{UID: types.UID(claimUID)}},
+		ClaimParameters: claimParams,
+		ClassParameters: pcicrd.DefaultDeviceClassParametersSpec(),
+	}
+}
+
+func TestAllocateDisjointDevices(t *testing.T) {
+	crd := &nascrd.NodeAllocationState{
+		Spec: *allocationSpec(
+			[]string{"dev-0", "dev-1", "dev-2", "dev-3", "dev-4", "dev-5"},
+			map[string][]string{"claim-allocated": {"dev-0"}},
+		),
+	}
+	driver := NewPciDriver()
+	driver.PendingAllocatedClaims, _ = newTestPendingAllocations()
+
+	owners := map[string]string{"dev-0": "claim-allocated"}
+	allocate := func(claimUID string, count int) []string {
+		t.Helper()
+		allocated := driver.allocate(crd, nil, []*controller.ClaimAllocation{testClaimAllocation(claimUID, count)}, nil, "node01")
+		for _, uuid := range allocated[claimUID] {
+			if owner, exists := owners[uuid]; exists {
+				t.Errorf("device %s allocated to %s is allocated to %s as well", uuid, owner, claimUID)
+			}
+			owners[uuid] = claimUID
+		}
+		return allocated[claimUID]
+	}
+
+	// The first allocation is pending, as between UnsuitableNodes and Allocate.
+	first := allocate("claim-pending", 2)
+	if len(first) != 2 {
+		t.Fatalf("allocated %v to the pending claim, want 2 devices", first)
+	}
+	driver.PendingAllocatedClaims.Set("claim-pending", "node01", "default/pod-a", pendingDevices(first...))
+
+	// The second allocation is recorded in the NodeAllocationState.
+	second := allocate("claim-b", 3)
+	if len(second) != 3 {
+		t.Fatalf("allocated %v to the second claim, want 3 devices", second)
+	}
+	crd.Spec.AllocatedClaims["claim-b"] = pendingDevices(second...)
+
+	// Every device is allocated or pending now.
+	if third := allocate("claim-c", 1); len(third) != 0 {
+		t.Errorf("allocated %v to the third claim, want none", third)
+	}
+}
+
+func TestAllocateIOMMUGroups(t *testing.T) {
+	device := func(uuid string, resourceName string, iommuGroup string) nascrd.AllocatableDevice {
+		return nascrd.AllocatableDevice{Pci: &nascrd.AllocatablePci{UUID: uuid, ResourceName: resourceName, IOMMUGroup: iommuGroup}}
+	}
+	tests := []struct {
+		name           string
+		devices        []nascrd.AllocatableDevice
+		allocationMode string
+		count          int
+		want           []string
+	}{
+		{
+			name:    "group members count as devices",
+			devices: []nascrd.AllocatableDevice{device("nvme-0", "nvme", "7"), device("nvme-1", "nvme", "7"), device("nvme-2", "nvme", "8")},
+			count:   2,
+			want:    []string{"nvme-0", "nvme-1"},
+		},
+		{
+			name:    "group exceeding the count is skipped",
+			devices: []nascrd.AllocatableDevice{device("nvme-0", "nvme", "7"), device("nvme-1", "nvme", "7"), device("nvme-2", "nvme", "8")},
+			count:   1,
+			want:    []string{"nvme-2"},
+		},
+		{
+			name:    "companions come on top of the count",
+			devices: []nascrd.AllocatableDevice{device("nvme-0", "nvme", "7"), device("nic-0", "nic", "7"), device("nvme-1", "nvme", "8")},
+			count:   2,
+			want:    []string{"nvme-0", "nic-0", "nvme-1"},
+		},
+		{
+			name:    "groups not adding up to the count",
+			devices: []nascrd.AllocatableDevice{device("nvme-0", "nvme", "7"), device("nvme-1", "nvme", "7"), device("nvme-2", "nvme", "8"), device("nvme-3", "nvme", "8")},
+			count:   3,
+		},
+		{
+			name:           "all devices",
+			devices:        []nascrd.AllocatableDevice{device("nvme-0", "nvme", "7"), device("nic-0", "nic", "7"), device("nic-1", "nic", "8")},
+			allocationMode: pcicrd.AllAllocationMode,
+			want:           []string{"nvme-0", "nic-0"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			crd := &nascrd.NodeAllocationState{
+				Spec: nascrd.NodeAllocationStateSpec{AllocatableDevices: tt.devices},
+			}
+			ca := testClaimAllocation("claim", tt.count)
+			claimParams := ca.ClaimParameters.(*pcicrd.PciClaimParametersSpec)
+			claimParams.DeviceName = "nvme"
+			if tt.allocationMode != "" {
+				claimParams.AllocationMode = tt.allocationMode
+			}
+
+			allocated := NewPciDriver().allocate(crd, nil, []*controller.ClaimAllocation{ca}, nil, "node01")
+			if !reflect.DeepEqual(allocated["claim"], tt.want) {
+				t.Errorf("allocated %v, want %v", allocated["claim"], tt.want)
+			}
+		})
+	}
+}
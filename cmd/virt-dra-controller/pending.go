@@ -0,0 +1,93 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	resourcev1 "k8s.io/api/resource/v1alpha2"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// podKey identifies the pod pending allocations are made for. A
+// PodSchedulingContext has the namespace and name of its pod.
+func podKey(pod *corev1.Pod) string {
+	return types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}.String()
+}
+
+// StartPendingAllocationCollector drops the devices tentatively reserved in
+// UnsuitableNodes that can no longer be allocated: the reservations of a pod
+// on other nodes once the scheduler selected a node for it, all of them once
+// its PodSchedulingContext is gone, and any reservation not renewed within
+// the configured TTL. The informer factory must be started by the caller.
+func StartPendingAllocationCollector(ctx context.Context, config *Config, driver *driver, informerFactory informers.SharedInformerFactory) error {
+	logger := klog.LoggerWithName(klog.FromContext(ctx), "pending-allocations")
+	pending := driver.pci.PendingAllocatedClaims
+
+	informer := informerFactory.Resource().V1alpha2().PodSchedulingContexts().Informer()
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			dropUnselectedNodes(logger, pending, obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			dropUnselectedNodes(logger, pending, newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+			if err != nil {
+				return
+			}
+			if removed := pending.RemovePod(key, ""); removed > 0 {
+				logger.V(3).Info("Dropped pending allocations of pod without scheduling context", "pod", key, "count", removed)
+			}
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("add event handler: %v", err)
+	}
+
+	ttl := config.flags.pendingAllocationTTL
+	if ttl <= 0 {
+		return nil
+	}
+	go wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if removed := pending.RemoveExpired(ttl); removed > 0 {
+			logger.V(3).Info("Dropped expired pending allocations", "count", removed, "ttl", ttl)
+		}
+	}, ttl/2)
+
+	return nil
+}
+
+// dropUnselectedNodes drops the reservations of the pod of a
+// PodSchedulingContext on the nodes other than the one selected for it.
+func dropUnselectedNodes(logger klog.Logger, pending *PerNodeAllocatedClaims, obj interface{}) {
+	schedulingCtx, ok := obj.(*resourcev1.PodSchedulingContext)
+	if !ok || schedulingCtx.Spec.SelectedNode == "" {
+		return
+	}
+	key := types.NamespacedName{Namespace: schedulingCtx.Namespace, Name: schedulingCtx.Name}.String()
+	if removed := pending.RemovePod(key, schedulingCtx.Spec.SelectedNode); removed > 0 {
+		logger.V(3).Info("Dropped pending allocations on nodes not selected for pod", "pod", key, "selectedNode", schedulingCtx.Spec.SelectedNode, "count", removed)
+	}
+}
@@ -0,0 +1,245 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+
+	nascrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/nas/v1alpha1"
+	pcicrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/v1alpha1"
+)
+
+// placementDomain restricts an allocation to the devices it accepts.
+type placementDomain func(device *nascrd.AllocatablePci) bool
+
+func anyDevice(device *nascrd.AllocatablePci) bool {
+	return true
+}
+
+// validatePodPlacement checks the placement annotations of pod.
+func validatePodPlacement(pod *corev1.Pod) error {
+	if pod == nil {
+		return nil
+	}
+	switch affinity := pod.Annotations[pcicrd.PodNUMAAffinityAnnotation]; affinity {
+	case "", pcicrd.SingleNUMANodeAffinity:
+	default:
+		return fmt.Errorf("unknown value of annotation %s: %s", pcicrd.PodNUMAAffinityAnnotation, affinity)
+	}
+	switch locality := pod.Annotations[pcicrd.PodPCIeLocalityAnnotation]; locality {
+	case "", pcicrd.SwitchPCIeLocality, pcicrd.RootPortPCIeLocality, pcicrd.RootComplexPCIeLocality:
+	default:
+		return fmt.Errorf("unknown value of annotation %s: %s", pcicrd.PodPCIeLocalityAnnotation, locality)
+	}
+	return nil
+}
+
+// podPlacementDomains returns the domains one of which has to hold the devices
+// of all claims of pod. Without placement annotations that is a single domain
+// accepting every device.
+func podPlacementDomains(devices []nascrd.AllocatableDevice, pod *corev1.Pod) []placementDomain {
+	domains := []placementDomain{anyDevice}
+	if pod == nil {
+		return domains
+	}
+
+	if pod.Annotations[pcicrd.PodNUMAAffinityAnnotation] == pcicrd.SingleNUMANodeAffinity {
+		var numaDomains []placementDomain
+		for _, numaNode := range numaNodes(devices) {
+			numaNode := numaNode
+			numaDomains = append(numaDomains, func(device *nascrd.AllocatablePci) bool {
+				return onNUMANode(device, numaNode)
+			})
+		}
+		domains = intersectDomains(domains, numaDomains)
+	}
+
+	if locality := pod.Annotations[pcicrd.PodPCIeLocalityAnnotation]; locality != "" {
+		var pcieDomains []placementDomain
+		for _, key := range pcieDomainKeys(devices, locality) {
+			key := key
+			pcieDomains = append(pcieDomains, func(device *nascrd.AllocatablePci) bool {
+				return pcieDomainKey(device, locality) == key
+			})
+		}
+		domains = intersectDomains(domains, pcieDomains)
+	}
+
+	return domains
+}
+
+// intersectDomains returns the intersection of every domain in a with every
+// domain in b.
+func intersectDomains(a []placementDomain, b []placementDomain) []placementDomain {
+	var domains []placementDomain
+	for _, x := range a {
+		for _, y := range b {
+			x, y := x, y
+			domains = append(domains, func(device *nascrd.AllocatablePci) bool {
+				return x(device) && y(device)
+			})
+		}
+	}
+	return domains
+}
+
+// unitInDomain reports whether every device of unit lies within domain.
+func unitInDomain(unit []*nascrd.AllocatablePci, domain placementDomain) bool {
+	for _, device := range unit {
+		if !domain(device) {
+			return false
+		}
+	}
+	return true
+}
+
+// numaNodes returns the known NUMA nodes of the devices in ascending order.
+func numaNodes(devices []nascrd.AllocatableDevice) []int {
+	seen := make(map[int]struct{})
+	var nodes []int
+	for _, device := range devices {
+		if device.Type() != nascrd.PciDeviceType || device.Pci.NumaNode == nil {
+			continue
+		}
+		if _, exists := seen[*device.Pci.NumaNode]; exists {
+			continue
+		}
+		seen[*device.Pci.NumaNode] = struct{}{}
+		nodes = append(nodes, *device.Pci.NumaNode)
+	}
+	sort.Ints(nodes)
+	return nodes
+}
+
+// onNUMANode reports whether device is known to be attached to numaNode.
+func onNUMANode(device *nascrd.AllocatablePci, numaNode int) bool {
+	return device != nil && device.NumaNode != nil && *device.NumaNode == numaNode
+}
+
+// unitOnNUMANode reports whether every device of unit is attached to numaNode.
+func unitOnNUMANode(unit []*nascrd.AllocatablePci, numaNode int) bool {
+	for _, device := range unit {
+		if !onNUMANode(device, numaNode) {
+			return false
+		}
+	}
+	return true
+}
+
+// pcieDomainKey identifies the part of the PCIe hierarchy at locality that
+// device is attached below. Devices below the same switch share the root port
+// and the upstream port of the switch, so their bridge chains share the first
+// two bridges. An empty key means that device is not below such a part, e.g.
+// because it is attached to a root port directly.
+func pcieDomainKey(device *nascrd.AllocatablePci, locality string) string {
+	if device == nil || device.RootComplex == "" {
+		return ""
+	}
+	switch locality {
+	case pcicrd.RootComplexPCIeLocality:
+		return device.RootComplex
+	case pcicrd.RootPortPCIeLocality:
+		if len(device.UpstreamBridges) < 1 {
+			return ""
+		}
+		return device.RootComplex + "/" + device.UpstreamBridges[0]
+	case pcicrd.SwitchPCIeLocality:
+		if len(device.UpstreamBridges) < 2 {
+			return ""
+		}
+		return device.RootComplex + "/" + device.UpstreamBridges[0] + "/" + device.UpstreamBridges[1]
+	}
+	return ""
+}
+
+// pcieDomainKeys returns the distinct, non-empty PCIe domain keys of the
+// devices at locality in ascending order.
+func pcieDomainKeys(devices []nascrd.AllocatableDevice, locality string) []string {
+	seen := make(map[string]struct{})
+	var keys []string
+	for _, device := range devices {
+		if device.Type() != nascrd.PciDeviceType {
+			continue
+		}
+		key := pcieDomainKey(device.Pci, locality)
+		if key == "" {
+			continue
+		}
+		if _, exists := seen[key]; exists {
+			continue
+		}
+		seen[key] = struct{}{}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// unitPCIeDomainKey returns the PCIe domain key shared by every device of
+// unit at locality, or an empty string if they do not share one.
+func unitPCIeDomainKey(unit []*nascrd.AllocatablePci, locality string) string {
+	key := ""
+	for i, device := range unit {
+		deviceKey := pcieDomainKey(device, locality)
+		if i > 0 && deviceKey != key {
+			return ""
+		}
+		key = deviceKey
+	}
+	return key
+}
+
+// localCandidates narrows the candidate units of a claim with a PCIe locality
+// down to those of a single PCIe domain: the first one holding enough matching
+// devices, or the one holding the most if the claim asks for all devices.
+func localCandidates(candidates [][]*nascrd.AllocatablePci, claimParams *pcicrd.PciClaimParametersSpec, classParams *pcicrd.DeviceClassParametersSpec) [][]*nascrd.AllocatablePci {
+	var keys []string
+	groups := make(map[string][][]*nascrd.AllocatablePci)
+	for _, unit := range candidates {
+		key := unitPCIeDomainKey(unit, claimParams.PCIeLocality)
+		if key == "" {
+			continue
+		}
+		if _, exists := groups[key]; !exists {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], unit)
+	}
+
+	var local [][]*nascrd.AllocatablePci
+	localMatching := 0
+	for _, key := range keys {
+		group := groups[key]
+		if claimParams.AllocationMode == pcicrd.AllAllocationMode {
+			matching := 0
+			for _, unit := range group {
+				matching += matchingDevices(unit, claimParams, classParams)
+			}
+			if matching > localMatching {
+				local, localMatching = group, matching
+			}
+			continue
+		}
+		if selectUnits(group, claimParams, classParams) != nil {
+			return group
+		}
+	}
+	return local
+}
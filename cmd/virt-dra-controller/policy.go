@@ -0,0 +1,206 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	nascrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/nas/v1alpha1"
+	pcicrd "kubevirt.io/dra-pci-driver/api/kubevirt.io/resource/pci/v1alpha1"
+)
+
+// allocationPolicy decides which of the candidate units of a claim are
+// allocated. The allocation takes units from the front of the order.
+type allocationPolicy interface {
+	order(candidates [][]*nascrd.AllocatablePci, usage *nodeUsage) [][]*nascrd.AllocatablePci
+}
+
+// allocationPolicies maps the policy names of DeviceClassParameters to their
+// implementation.
+var allocationPolicies = map[string]allocationPolicy{
+	pcicrd.FirstFitAllocationPolicy:          firstFitPolicy{},
+	pcicrd.PackAllocationPolicy:              packPolicy{},
+	pcicrd.SpreadNUMAAllocationPolicy:        spreadNUMAPolicy{},
+	pcicrd.LeastRecentlyUsedAllocationPolicy: leastRecentlyUsedPolicy{},
+}
+
+// nodeUsage describes which devices of a node are in use, including those
+// picked earlier for other claims of the same allocation.
+type nodeUsage struct {
+	devices      map[string]*nascrd.AllocatablePci
+	used         map[string]struct{}
+	releaseTimes map[string]metav1.Time
+}
+
+// usedOnNUMANode returns the number of devices in use per NUMA node.
+func (u *nodeUsage) usedOnNUMANode() map[int]int {
+	used := make(map[int]int)
+	for uuid := range u.used {
+		device := u.devices[uuid]
+		if device == nil || device.NumaNode == nil {
+			continue
+		}
+		used[*device.NumaNode]++
+	}
+	return used
+}
+
+// classAllocationPolicy returns the name of the allocation policy of a
+// resource class.
+func classAllocationPolicy(classParams *pcicrd.DeviceClassParametersSpec) string {
+	if classParams == nil || classParams.AllocationPolicy == "" {
+		return pcicrd.FirstFitAllocationPolicy
+	}
+	return classParams.AllocationPolicy
+}
+
+// classPolicy returns the allocation policy of a resource class, falling back
+// to first fit for unknown policies.
+func classPolicy(classParams *pcicrd.DeviceClassParametersSpec) allocationPolicy {
+	policy, exists := allocationPolicies[classAllocationPolicy(classParams)]
+	if !exists {
+		return firstFitPolicy{}
+	}
+	return policy
+}
+
+// validateAllocationPolicy checks that the allocation policy of a resource
+// class is known.
+func validateAllocationPolicy(classParams *pcicrd.DeviceClassParametersSpec) error {
+	if _, exists := allocationPolicies[classAllocationPolicy(classParams)]; !exists {
+		return fmt.Errorf("unknown allocation policy: %s", classParams.AllocationPolicy)
+	}
+	return nil
+}
+
+// firstFitPolicy prefers the units with the lowest PCI addresses.
+type firstFitPolicy struct{}
+
+func (firstFitPolicy) order(candidates [][]*nascrd.AllocatablePci, usage *nodeUsage) [][]*nascrd.AllocatablePci {
+	ordered := append([][]*nascrd.AllocatablePci(nil), candidates...)
+	sortByAddress(ordered)
+	return ordered
+}
+
+// packPolicy prefers the units on the NUMA nodes with the most devices in use,
+// so that NUMA nodes without allocations stay free for large claims.
+type packPolicy struct{}
+
+func (packPolicy) order(candidates [][]*nascrd.AllocatablePci, usage *nodeUsage) [][]*nascrd.AllocatablePci {
+	used := usage.usedOnNUMANode()
+	ordered := append([][]*nascrd.AllocatablePci(nil), candidates...)
+	sortByAddress(ordered)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return used[unitNUMANode(ordered[i])] > used[unitNUMANode(ordered[j])]
+	})
+	return ordered
+}
+
+// spreadNUMAPolicy takes the units from the NUMA nodes in turn, starting with
+// the one with the fewest devices in use.
+type spreadNUMAPolicy struct{}
+
+func (spreadNUMAPolicy) order(candidates [][]*nascrd.AllocatablePci, usage *nodeUsage) [][]*nascrd.AllocatablePci {
+	sorted := append([][]*nascrd.AllocatablePci(nil), candidates...)
+	sortByAddress(sorted)
+
+	var numaNodes []int
+	groups := make(map[int][][]*nascrd.AllocatablePci)
+	for _, unit := range sorted {
+		numaNode := unitNUMANode(unit)
+		if _, exists := groups[numaNode]; !exists {
+			numaNodes = append(numaNodes, numaNode)
+		}
+		groups[numaNode] = append(groups[numaNode], unit)
+	}
+
+	used := usage.usedOnNUMANode()
+	sort.SliceStable(numaNodes, func(i, j int) bool {
+		if used[numaNodes[i]] != used[numaNodes[j]] {
+			return used[numaNodes[i]] < used[numaNodes[j]]
+		}
+		return numaNodes[i] < numaNodes[j]
+	})
+
+	ordered := make([][]*nascrd.AllocatablePci, 0, len(sorted))
+	for len(ordered) < len(sorted) {
+		for _, numaNode := range numaNodes {
+			if len(groups[numaNode]) == 0 {
+				continue
+			}
+			ordered = append(ordered, groups[numaNode][0])
+			groups[numaNode] = groups[numaNode][1:]
+		}
+	}
+	return ordered
+}
+
+// leastRecentlyUsedPolicy prefers the units released longest ago. Units that
+// were never released come first.
+type leastRecentlyUsedPolicy struct{}
+
+func (leastRecentlyUsedPolicy) order(candidates [][]*nascrd.AllocatablePci, usage *nodeUsage) [][]*nascrd.AllocatablePci {
+	lastReleased := func(unit []*nascrd.AllocatablePci) metav1.Time {
+		var last metav1.Time
+		for _, device := range unit {
+			if released := usage.releaseTimes[device.UUID]; last.Before(&released) {
+				last = released
+			}
+		}
+		return last
+	}
+
+	ordered := append([][]*nascrd.AllocatablePci(nil), candidates...)
+	sortByAddress(ordered)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		a, b := lastReleased(ordered[i]), lastReleased(ordered[j])
+		return a.Before(&b)
+	})
+	return ordered
+}
+
+// sortByAddress sorts units by their lowest PCI address.
+func sortByAddress(units [][]*nascrd.AllocatablePci) {
+	sort.SliceStable(units, func(i, j int) bool {
+		return unitAddress(units[i]) < unitAddress(units[j])
+	})
+}
+
+// unitAddress returns the lowest PCI address of the devices of unit.
+func unitAddress(unit []*nascrd.AllocatablePci) string {
+	address := ""
+	for i, device := range unit {
+		if i == 0 || device.PciAddress < address {
+			address = device.PciAddress
+		}
+	}
+	return address
+}
+
+// unitNUMANode returns the NUMA node of the first device of unit that knows
+// its NUMA node, or -1.
+func unitNUMANode(unit []*nascrd.AllocatablePci) int {
+	for _, device := range unit {
+		if device.NumaNode != nil {
+			return *device.NumaNode
+		}
+	}
+	return -1
+}
@@ -24,6 +24,9 @@ kubectl delete -f ../deployments/native/dra-pci-driver/templates/namespace.yaml
 kubectl delete -f ../deployments/native/dra-pci-driver/templates/serviceaccount.yaml
 kubectl delete -f ../deployments/native/dra-pci-driver/templates/clusterrole.yaml
 kubectl delete -f ../deployments/native/dra-pci-driver/templates/clusterrolebinding.yaml
+kubectl delete -f ../deployments/native/dra-pci-driver/templates/role.yaml
+kubectl delete -f ../deployments/native/dra-pci-driver/templates/rolebinding.yaml
+kubectl delete -f ../deployments/native/dra-pci-driver/templates/validatingadmissionpolicy.yaml
 kubectl delete -f ../deployments/native/dra-pci-driver/templates/resourceclass.yaml
 kubectl delete -f ../deployments/native/dra-pci-driver/templates/controller.yaml
 kubectl delete -f ../deployments/native/dra-pci-driver/templates/kubeletplugin.yaml
\ No newline at end of file
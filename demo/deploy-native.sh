@@ -25,6 +25,17 @@ kubectl apply -f ../deployments/native/dra-pci-driver/templates/namespace.yaml
 kubectl apply -f ../deployments/native/dra-pci-driver/templates/serviceaccount.yaml
 kubectl apply -f ../deployments/native/dra-pci-driver/templates/clusterrole.yaml
 kubectl apply -f ../deployments/native/dra-pci-driver/templates/clusterrolebinding.yaml
+kubectl apply -f ../deployments/native/dra-pci-driver/templates/role.yaml
+kubectl apply -f ../deployments/native/dra-pci-driver/templates/rolebinding.yaml
+kubectl apply -f ../deployments/native/dra-pci-driver/templates/validatingadmissionpolicy.yaml
 kubectl apply -f ../deployments/native/dra-pci-driver/templates/resourceclass.yaml
 kubectl apply -f ../deployments/native/dra-pci-driver/templates/controller.yaml
-kubectl apply -f ../deployments/native/dra-pci-driver/templates/kubeletplugin.yaml
\ No newline at end of file
+kubectl apply -f ../deployments/native/dra-pci-driver/templates/kubeletplugin.yaml
+
+# Serve a fake device inventory instead of the devices of the nodes, e.g.
+# FAKE_DEVICES=fake-devices.yaml ./deploy-native.sh
+if [ -n "${FAKE_DEVICES}" ]; then
+  kubectl create configmap dra-pci-driver-fake-devices -n dra-pci-driver \
+    --from-file=fake-devices.yaml="${FAKE_DEVICES}" --dry-run=client -o yaml | kubectl apply -f -
+  kubectl patch daemonset dra-pci-driver-kubeletplugin -n dra-pci-driver --patch-file fake-devices-patch.yaml
+fi
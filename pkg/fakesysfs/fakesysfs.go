@@ -0,0 +1,303 @@
+/*
+ * Copyright 2024 The KubeVirt Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package fakesysfs materializes a minimal sysfs tree of PCI devices in a
+// regular directory, so that device discovery can be exercised on machines
+// without passthrough hardware.
+package fakesysfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	devicesPath     = "devices"
+	pciDevicesPath  = "bus/pci/devices"
+	pciDriversPath  = "bus/pci/drivers"
+	iommuGroupsPath = "kernel/iommu_groups"
+)
+
+// Device describes a PCI device to be created in the fake sysfs tree.
+type Device struct {
+	// Address is the PCI address of the device, e.g. 0000:00:1d.0.
+	Address string
+	// PCIID is the vendor:device ID of the device, e.g. 1b36:0010.
+	PCIID string
+	// Class is the class code of the device, e.g. 010802. Empty means 000000.
+	Class string
+	// SubsystemID is the subsystem vendor:device ID of the device, e.g.
+	// 1af4:1100. Empty means 0000:0000.
+	SubsystemID string
+	// SerialNumber is the device serial number of the device in the format
+	// printed by lspci, e.g. 00-1b-21-ff-ff-8a-3c-10. Empty means none.
+	SerialNumber string
+	// LinkSpeed and LinkWidth are the negotiated PCIe link speed and width
+	// of the device, e.g. "16.0 GT/s PCIe" and 4. Empty means no link.
+	LinkSpeed string
+	LinkWidth int
+	// Driver is the driver the device is bound to. Empty means unbound.
+	Driver string
+	// IOMMUGroup is the IOMMU group of the device. Empty means none.
+	IOMMUGroup string
+	// NumaNode is the NUMA node of the device, -1 if unknown.
+	NumaNode int
+	// Parent is the address of the bridge the device is attached to, which
+	// must have been added before. Empty means the root bus.
+	Parent string
+}
+
+// FS is a fake sysfs tree rooted at a directory.
+type FS struct {
+	root string
+}
+
+// New creates the skeleton of a fake sysfs tree below root.
+func New(root string) (*FS, error) {
+	for _, dir := range []string{devicesPath, pciDevicesPath, pciDriversPath, iommuGroupsPath} {
+		err := os.MkdirAll(filepath.Join(root, dir), 0755)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create %s: %v", dir, err)
+		}
+	}
+	return &FS{root: root}, nil
+}
+
+// Root returns the directory to be used in place of /sys.
+func (fs *FS) Root() string {
+	return fs.root
+}
+
+// AddDevice materializes device in the tree, including its uevent, numa_node,
+// class, subsystem_vendor, subsystem_device, config, reset, link, driver and
+// iommu_group entries and the links from the
+// bus, driver and IOMMU group directories back to it.
+func (fs *FS) AddDevice(device Device) error {
+	address := strings.ToLower(device.Address)
+	parts := strings.Split(address, ":")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed PCI address: %s", device.Address)
+	}
+
+	parentPath := filepath.Join(fs.root, devicesPath, "pci"+parts[0]+":"+parts[1])
+	if device.Parent != "" {
+		var err error
+		parentPath, err = filepath.EvalSymlinks(filepath.Join(fs.root, pciDevicesPath, strings.ToLower(device.Parent)))
+		if err != nil {
+			return fmt.Errorf("unable to resolve parent of %s: %v", address, err)
+		}
+	}
+
+	devicePath := filepath.Join(parentPath, address)
+	err := os.MkdirAll(devicePath, 0755)
+	if err != nil {
+		return fmt.Errorf("unable to create device directory for %s: %v", address, err)
+	}
+
+	uevent := fmt.Sprintf("PCI_ID=%s\nPCI_SLOT_NAME=%s\n", strings.ToUpper(device.PCIID), address)
+	if device.Driver != "" {
+		uevent = "DRIVER=" + device.Driver + "\n" + uevent
+	}
+	err = os.WriteFile(filepath.Join(devicePath, "uevent"), []byte(uevent), 0644)
+	if err != nil {
+		return fmt.Errorf("unable to write uevent for %s: %v", address, err)
+	}
+
+	err = os.WriteFile(filepath.Join(devicePath, "numa_node"), []byte(strconv.Itoa(device.NumaNode)+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("unable to write numa_node for %s: %v", address, err)
+	}
+
+	subsystemID := device.SubsystemID
+	if subsystemID == "" {
+		subsystemID = "0000:0000"
+	}
+	config, err := configSpace(device.PCIID, subsystemID, device.SerialNumber)
+	if err != nil {
+		return fmt.Errorf("invalid device %s: %v", address, err)
+	}
+	subsystem := strings.Split(strings.ToLower(subsystemID), ":")
+	class := device.Class
+	if class == "" {
+		class = "000000"
+	}
+	for name, content := range map[string][]byte{
+		"class":            []byte("0x" + strings.ToLower(class) + "\n"),
+		"subsystem_vendor": []byte("0x" + subsystem[0] + "\n"),
+		"subsystem_device": []byte("0x" + subsystem[1] + "\n"),
+		"config":           config,
+		"reset":            nil,
+		"reset_method":     []byte("flr bus\n"),
+	} {
+		err = os.WriteFile(filepath.Join(devicePath, name), content, 0644)
+		if err != nil {
+			return fmt.Errorf("unable to write %s for %s: %v", name, address, err)
+		}
+	}
+
+	if device.LinkSpeed != "" {
+		for name, content := range map[string]string{
+			"current_link_speed": device.LinkSpeed,
+			"current_link_width": strconv.Itoa(device.LinkWidth),
+		} {
+			err = os.WriteFile(filepath.Join(devicePath, name), []byte(content+"\n"), 0644)
+			if err != nil {
+				return fmt.Errorf("unable to write %s for %s: %v", name, address, err)
+			}
+		}
+	}
+
+	err = symlink(devicePath, filepath.Join(fs.root, pciDevicesPath, address))
+	if err != nil {
+		return err
+	}
+
+	if device.Driver != "" {
+		driverPath := filepath.Join(fs.root, pciDriversPath, device.Driver)
+		err = symlink(driverPath, filepath.Join(devicePath, "driver"))
+		if err != nil {
+			return err
+		}
+		err = symlink(devicePath, filepath.Join(driverPath, address))
+		if err != nil {
+			return err
+		}
+	}
+
+	if device.IOMMUGroup != "" {
+		groupPath := filepath.Join(fs.root, iommuGroupsPath, device.IOMMUGroup)
+		err = symlink(groupPath, filepath.Join(devicePath, "iommu_group"))
+		if err != nil {
+			return err
+		}
+		err = symlink(devicePath, filepath.Join(groupPath, "devices", address))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RemoveDevice removes the device with the given PCI address and every link
+// pointing to it from the tree.
+func (fs *FS) RemoveDevice(address string) error {
+	address = strings.ToLower(address)
+	busLink := filepath.Join(fs.root, pciDevicesPath, address)
+	devicePath, err := filepath.EvalSymlinks(busLink)
+	if err != nil {
+		return fmt.Errorf("unable to resolve device %s: %v", address, err)
+	}
+
+	for _, entry := range []string{"driver", "iommu_group"} {
+		target, err := filepath.EvalSymlinks(filepath.Join(devicePath, entry))
+		if err != nil {
+			continue
+		}
+		link := filepath.Join(target, address)
+		if entry == "iommu_group" {
+			link = filepath.Join(target, "devices", address)
+		}
+		err = os.Remove(link)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove %s: %v", link, err)
+		}
+	}
+
+	err = os.Remove(busLink)
+	if err != nil {
+		return fmt.Errorf("unable to remove %s: %v", busLink, err)
+	}
+	return os.RemoveAll(devicePath)
+}
+
+// configSpace returns the 4096 byte config space of a PCIe device with the
+// given vendor:device and subsystem IDs, as read with CAP_SYS_ADMIN. Only the
+// IDs are filled in. With a serial number, the extended config space holds a
+// device serial number capability only.
+func configSpace(pciID string, subsystemID string, serialNumber string) ([]byte, error) {
+	vendor, device, err := parseID(pciID)
+	if err != nil {
+		return nil, err
+	}
+	subsystemVendor, subsystemDevice, err := parseID(subsystemID)
+	if err != nil {
+		return nil, err
+	}
+
+	config := make([]byte, 64)
+	binary.LittleEndian.PutUint16(config[0x00:], vendor)
+	binary.LittleEndian.PutUint16(config[0x02:], device)
+	binary.LittleEndian.PutUint16(config[0x2c:], subsystemVendor)
+	binary.LittleEndian.PutUint16(config[0x2e:], subsystemDevice)
+	config = append(config, make([]byte, 4096-len(config))...)
+	if serialNumber == "" {
+		return config, nil
+	}
+
+	serial, err := strconv.ParseUint(strings.ReplaceAll(serialNumber, "-", ""), 16, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed serial number %q: %v", serialNumber, err)
+	}
+	// Device serial number capability, version 1, last in the list.
+	binary.LittleEndian.PutUint32(config[0x100:], 0x00010003)
+	binary.LittleEndian.PutUint32(config[0x104:], uint32(serial))
+	binary.LittleEndian.PutUint32(config[0x108:], uint32(serial>>32))
+	return config, nil
+}
+
+// parseID splits a vendor:device ID into its parts.
+func parseID(id string) (uint16, uint16, error) {
+	ids := strings.Split(id, ":")
+	if len(ids) != 2 {
+		return 0, 0, fmt.Errorf("malformed vendor:device ID %q", id)
+	}
+	vendor, err := strconv.ParseUint(ids[0], 16, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("malformed vendor ID %q: %v", ids[0], err)
+	}
+	device, err := strconv.ParseUint(ids[1], 16, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("malformed device ID %q: %v", ids[1], err)
+	}
+	return uint16(vendor), uint16(device), nil
+}
+
+// symlink creates a relative symbolic link at link pointing to target, the way
+// the kernel lays out sysfs.
+func symlink(target string, link string) error {
+	err := os.MkdirAll(filepath.Dir(link), 0755)
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %v", filepath.Dir(link), err)
+	}
+	err = os.MkdirAll(target, 0755)
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %v", target, err)
+	}
+	relative, err := filepath.Rel(filepath.Dir(link), target)
+	if err != nil {
+		return fmt.Errorf("unable to compute link from %s to %s: %v", link, target, err)
+	}
+	err = os.Symlink(relative, link)
+	if err != nil {
+		return fmt.Errorf("unable to link %s to %s: %v", link, target, err)
+	}
+	return nil
+}
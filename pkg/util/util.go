@@ -37,3 +37,13 @@ func ResourceNameToEnvVar(prefix string, resourceName string) string {
 	varName = strings.Replace(varName, ".", "_", -1)
 	return fmt.Sprintf("%s_%s", prefix, varName)
 }
+
+// MatchesWildcard reports whether value matches pattern. A pattern of "*"
+// matches any value and a pattern ending in "*" matches any value with the
+// preceding prefix; any other pattern must match exactly.
+func MatchesWildcard(pattern string, value string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(value, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == value
+}